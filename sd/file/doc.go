@@ -0,0 +1,4 @@
+// Package file provides Instancer and Registrar implementations for JSON and YAML files.
+// The Instancer watches the file, and publishes the changes as soon as the file is changed.
+// It works in the environments where multicast is blocked, and the instances can be rotated by config management.
+package file
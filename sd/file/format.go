@@ -0,0 +1,190 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Format is the format of the instances file.
+type Format int
+
+const (
+	// FormatAuto detects the format by the extension of the file, YAML for ".yaml" and ".yml", otherwise JSON.
+	FormatAuto Format = iota
+	// FormatJSON is the JSON format.
+	FormatJSON
+	// FormatYAML is the YAML format.
+	FormatYAML
+)
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatJSON:
+		return "json"
+	case FormatYAML:
+		return "yaml"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+// detect returns the format of the file.
+func (f Format) detect(path string) Format {
+	if f != FormatAuto {
+		return f
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	default:
+		return FormatJSON
+	}
+}
+
+// Entry is an instance with its metadata, listed in the instances file.
+type Entry struct {
+	Instance string            // Instance address, as published through sd.Event
+	Metadata map[string]string // Optional metadata of the instance
+}
+
+// EntryEvent represents a push notification of the entries published.
+// It is the metadata-aware counterpart of sd.Event.
+type EntryEvent struct {
+	Entries []Entry
+	Err     error
+}
+
+// document is the content of the instances file, such as:
+//
+//	{"instances": ["127.0.0.1:8080", {"instance": "127.0.0.1:8081", "metadata": {"zone": "a"}}]}
+//
+// or in YAML:
+//
+//	instances:
+//	  - 127.0.0.1:8080
+//	  - instance: 127.0.0.1:8081
+//	    metadata:
+//	      zone: a
+type document struct {
+	Instances []entryValue `json:"instances" yaml:"instances"`
+}
+
+// entryValue is an entry in the file, an instance string if no metadata, otherwise an object.
+type entryValue Entry
+
+type entryObject struct {
+	Instance string            `json:"instance" yaml:"instance"`
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e entryValue) MarshalJSON() ([]byte, error) {
+	if len(e.Metadata) == 0 {
+		return json.Marshal(e.Instance)
+	}
+	return json.Marshal(entryObject(e))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *entryValue) UnmarshalJSON(data []byte) error {
+	var instance string
+	if err := json.Unmarshal(data, &instance); err == nil {
+		*e = entryValue{Instance: instance}
+		return nil
+	}
+	var object entryObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	*e = entryValue(object)
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (e entryValue) MarshalYAML() (interface{}, error) {
+	if len(e.Metadata) == 0 {
+		return e.Instance, nil
+	}
+	return entryObject(e), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (e *entryValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var instance string
+	if err := unmarshal(&instance); err == nil {
+		*e = entryValue{Instance: instance}
+		return nil
+	}
+	var object entryObject
+	if err := unmarshal(&object); err != nil {
+		return err
+	}
+	*e = entryValue(object)
+	return nil
+}
+
+var errEmptyInstance = errors.New("file: empty instance")
+
+// decode parses the entries of the content.
+// The duplicate instances are ignored, only the first occurrence of an instance is used.
+func decode(data []byte, format Format) ([]Entry, error) {
+	var doc document
+	var err error
+	switch format {
+	case FormatYAML:
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		if len(strings.TrimSpace(string(data))) == 0 {
+			break // empty file, no instances
+		}
+		err = json.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(doc.Instances))
+	seen := make(map[string]bool, len(doc.Instances))
+	for _, value := range doc.Instances {
+		if value.Instance == "" {
+			return nil, errEmptyInstance
+		}
+		if seen[value.Instance] {
+			continue
+		}
+		seen[value.Instance] = true
+		entries = append(entries, Entry(value))
+	}
+	return entries, nil
+}
+
+// encode formats the entries, sorted by the instances.
+func encode(entries []Entry, format Format) ([]byte, error) {
+	doc := document{Instances: make([]entryValue, 0, len(entries))}
+	for _, entry := range entries {
+		doc.Instances = append(doc.Instances, entryValue(entry))
+	}
+	sort.Slice(doc.Instances, func(i, j int) bool {
+		return doc.Instances[i].Instance < doc.Instances[j].Instance
+	})
+
+	switch format {
+	case FormatYAML:
+		return yaml.Marshal(doc)
+	default:
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+}
@@ -0,0 +1,77 @@
+package file
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	want := []Entry{
+		{Instance: "127.0.0.1:8080"},
+		{Instance: "127.0.0.1:8081", Metadata: map[string]string{"zone": "a"}},
+	}
+
+	for _, c := range []struct {
+		format Format
+		data   string
+	}{
+		{format: FormatJSON, data: `{"instances": ["127.0.0.1:8080", {"instance": "127.0.0.1:8081", "metadata": {"zone": "a"}}, "127.0.0.1:8080"]}`},
+		{format: FormatYAML, data: `
+instances:
+  - 127.0.0.1:8080
+  - instance: 127.0.0.1:8081
+    metadata:
+      zone: a
+  - 127.0.0.1:8080
+`},
+	} {
+		entries, err := decode([]byte(c.data), c.format)
+		if err != nil {
+			t.Fatalf("%s: %v", c.format, err)
+		}
+		if !reflect.DeepEqual(want, entries) {
+			t.Fatalf("%s: want %v, got %v", c.format, want, entries)
+		}
+
+		// round trip
+		data, err := encode(entries, c.format)
+		if err != nil {
+			t.Fatalf("%s: %v", c.format, err)
+		}
+		entries, err = decode(data, c.format)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", c.format, err, data)
+		}
+		if !reflect.DeepEqual(want, entries) {
+			t.Fatalf("%s: want %v, got %v\n%s", c.format, want, entries, data)
+		}
+	}
+
+	for _, format := range []Format{FormatJSON, FormatYAML} {
+		if entries, err := decode(nil, format); err != nil || len(entries) != 0 {
+			t.Errorf("%s: want no instances in empty file, got %v, %v", format, entries, err)
+		}
+	}
+	if _, err := decode([]byte(`{"instances": [{"metadata": {"zone": "a"}}]}`), FormatJSON); err == nil {
+		t.Error("want error of empty instance, got nil")
+	}
+	if _, err := decode([]byte(`{"instances": [`), FormatJSON); err == nil {
+		t.Error("want error of invalid JSON, got nil")
+	}
+}
+
+func TestFormatDetect(t *testing.T) {
+	for path, want := range map[string]Format{
+		"instances.json": FormatJSON,
+		"instances.yaml": FormatYAML,
+		"instances.YML":  FormatYAML,
+		"instances":      FormatJSON,
+	} {
+		if format := FormatAuto.detect(path); format != want {
+			t.Errorf("%s: want %s, got %s", path, want, format)
+		}
+	}
+	if format := FormatYAML.detect("instances.json"); format != FormatYAML {
+		t.Errorf("want the format given, got %s", format)
+	}
+}
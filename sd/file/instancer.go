@@ -0,0 +1,240 @@
+package file
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/sd"
+
+	"github.com/wencan/kit-plugins/sd/instance"
+	"github.com/wencan/kit-plugins/sd/internal/subscriber"
+)
+
+const defaultDebounce = time.Millisecond * 100
+
+// InstancerOptions is used to customize the instancer.
+type InstancerOptions struct {
+	Format Format // Format of the file, default FormatAuto
+
+	// Selector filters the entries by their metadata, see ParseSelector. All the entries are published if nil.
+	Selector Selector
+
+	// Debounce coalesces the changes of the file within the duration into one reload, default 100 milliseconds.
+	Debounce time.Duration
+}
+
+// Instancer yields instances from a JSON or YAML file, and reloads the file when it is changed.
+// The directory of the file is watched, so the file can be replaced by renaming, which is atomic,
+// or created after the instancer.
+// If the file is missing or invalid, the error is published.
+type Instancer struct {
+	path string // Absolute path of the file
+	opts InstancerOptions
+
+	watcher *fsnotify.Watcher
+
+	mtx     sync.RWMutex
+	entries []Entry // Entries of the latest load, selected
+
+	cache      *instance.Cache
+	entryCache *subscriber.Cache // Of EntryEvent
+
+	logger log.Logger
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewInstancer returns an instancer watching the file.
+func NewInstancer(path string, opts InstancerOptions, logger log.Logger) (*Instancer, error) {
+	if opts.Debounce == 0 {
+		opts.Debounce = defaultDebounce
+	}
+	opts.Format = opts.Format.detect(path)
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	inst := &Instancer{
+		path:    path,
+		opts:    opts,
+		watcher: watcher,
+		cache:   instance.NewCache(),
+		entryCache: subscriber.NewCache(EntryEvent{}, func(state interface{}) interface{} {
+			return copyEntryEvent(state.(EntryEvent))
+		}),
+		logger: logger,
+		quit:   make(chan struct{}),
+	}
+	inst.load()
+
+	inst.wg.Add(1)
+	go inst.loop()
+	return inst, nil
+}
+
+func (inst *Instancer) loop() {
+	defer inst.wg.Done()
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-inst.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != inst.path {
+				continue
+			}
+			level.Debug(inst.logger).Log("action", "watch", "file", event.Name, "op", event.Op)
+			if reload == nil {
+				reload = time.After(inst.opts.Debounce)
+			}
+		case err, ok := <-inst.watcher.Errors:
+			if !ok {
+				return
+			}
+			inst.logger.Log("action", "watch", "err", err)
+		case <-reload:
+			reload = nil
+			inst.load()
+		case <-inst.quit:
+			return
+		}
+	}
+}
+
+// load reads the file, and publishes the instances selected, or the error.
+func (inst *Instancer) load() {
+	entries, err := inst.read()
+	if err != nil {
+		inst.logger.Log("action", "read", "file", inst.path, "err", err)
+		inst.entryCache.Update(EntryEvent{Err: err})
+		inst.cache.Update(sd.Event{Err: err})
+		return
+	}
+
+	selected := make([]Entry, 0, len(entries))
+	instances := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if inst.opts.Selector != nil && !inst.opts.Selector.Matches(entry) {
+			keyvals := []interface{}{"action", "select", "instance", entry.Instance, "err", "not selected"}
+			if selector, ok := inst.opts.Selector.(labelSelector); ok {
+				r, _ := selector.unmatched(entry)
+				keyvals = append(keyvals, "unmatched", r.String())
+			}
+			level.Debug(inst.logger).Log(keyvals...)
+			continue
+		}
+		selected = append(selected, entry)
+		instances = append(instances, entry.Instance)
+	}
+
+	inst.mtx.Lock()
+	inst.entries = selected
+	inst.mtx.Unlock()
+	inst.entryCache.Update(EntryEvent{Entries: selected})
+	inst.cache.Update(sd.Event{Instances: instances})
+}
+
+func (inst *Instancer) read() ([]Entry, error) {
+	data, err := ioutil.ReadFile(inst.path)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data, inst.opts.Format)
+}
+
+// Entries returns the entries of the instances published, with their metadata.
+func (inst *Instancer) Entries() []Entry {
+	inst.mtx.RLock()
+	defer inst.mtx.RUnlock()
+
+	return copyEntries(inst.entries)
+}
+
+// RegisterEntries registers a channel receiving the entries published with their metadata, or the error.
+// Like Register, the current state is sent to the channel before it returns,
+// and the later events are delivered in a separate goroutine, only the latest one if the consumer falls behind.
+func (inst *Instancer) RegisterEntries(ch chan<- EntryEvent) {
+	inst.entryCache.Register(ch, func(value interface{}, quit <-chan struct{}) {
+		select {
+		case ch <- value.(EntryEvent):
+		case <-quit:
+		}
+	})
+}
+
+// DeregisterEntries deregisters a channel registered by RegisterEntries.
+// Nothing is sent to the channel after it returns.
+func (inst *Instancer) DeregisterEntries(ch chan<- EntryEvent) {
+	inst.entryCache.Deregister(ch)
+}
+
+// EntryState returns the current state of the entries (entries or error) as EntryEvent.
+func (inst *Instancer) EntryState() EntryEvent {
+	return inst.entryCache.State().(EntryEvent)
+}
+
+// Register implements Instancer.
+func (inst *Instancer) Register(ch chan<- sd.Event) {
+	inst.cache.Register(ch)
+}
+
+// Deregister implements Instancer.
+func (inst *Instancer) Deregister(ch chan<- sd.Event) {
+	inst.cache.Deregister(ch)
+}
+
+// State returns the current state of discovery (instances or error) as sd.Event
+func (inst *Instancer) State() sd.Event {
+	return inst.cache.State()
+}
+
+// Stop terminates the Instancer.
+func (inst *Instancer) Stop() {
+	close(inst.quit)
+	inst.watcher.Close()
+	inst.wg.Wait()
+	inst.cache.Stop()
+	inst.entryCache.Stop()
+}
+
+// copyEntries does a deep copy on the entries,
+// observers can modify the entries and metadata maps they received.
+func copyEntries(entries []Entry) []Entry {
+	result := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		metadata := make(map[string]string, len(entry.Metadata))
+		for key, value := range entry.Metadata {
+			metadata[key] = value
+		}
+		result = append(result, Entry{Instance: entry.Instance, Metadata: metadata})
+	}
+	return result
+}
+
+// copyEntryEvent does a deep copy on EntryEvent.
+func copyEntryEvent(e EntryEvent) EntryEvent {
+	if e.Entries == nil {
+		return e
+	}
+	e.Entries = copyEntries(e.Entries)
+	return e
+}
@@ -0,0 +1,170 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+)
+
+// waitFor polls the condition until it is met, or fails the test after a few seconds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func hasInstances(event sd.Event, want ...string) bool {
+	if len(want) == 0 {
+		return event.Err == nil && len(event.Instances) == 0
+	}
+	return event.Err == nil && reflect.DeepEqual(event.Instances, want)
+}
+
+func TestInstancer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-sd-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instances.yaml")
+
+	// Missing file
+	instancer, err := NewInstancer(path, InstancerOptions{
+		Selector: SelectorFunc(func(entry Entry) bool {
+			return entry.Metadata["zone"] != "b"
+		}),
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+	if state := instancer.State(); !os.IsNotExist(state.Err) {
+		t.Fatalf("want not exist error, got %v", state)
+	}
+
+	// Created
+	err = ioutil.WriteFile(path, []byte(`
+instances:
+  - 127.0.0.1:8080
+  - instance: 127.0.0.1:8081
+    metadata:
+      zone: a
+  - instance: 127.0.0.1:8082
+    metadata:
+      zone: b
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "file created", func() bool {
+		return hasInstances(instancer.State(), "127.0.0.1:8080", "127.0.0.1:8081")
+	})
+	want := []Entry{
+		{Instance: "127.0.0.1:8080", Metadata: map[string]string{}},
+		{Instance: "127.0.0.1:8081", Metadata: map[string]string{"zone": "a"}},
+	}
+	if entries := instancer.Entries(); !reflect.DeepEqual(want, entries) {
+		t.Fatalf("want %v, got %v", want, entries)
+	}
+
+	// Invalid
+	err = ioutil.WriteFile(path, []byte("instances: [\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "invalid file", func() bool {
+		return instancer.State().Err != nil
+	})
+
+	// Replaced by renaming
+	err = writeFile(path, []byte("instances: [127.0.0.1:8083]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "file replaced", func() bool {
+		return hasInstances(instancer.State(), "127.0.0.1:8083")
+	})
+
+	// Removed
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "file removed", func() bool {
+		return os.IsNotExist(instancer.State().Err)
+	})
+}
+
+func TestInstancerEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-sd-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instances.yaml")
+	err = ioutil.WriteFile(path, []byte("instances: [{instance: 127.0.0.1:8080, metadata: {zone: a}}, {instance: 127.0.0.1:8081, metadata: {zone: b}}]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selector, err := ParseSelector("zone=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instancer, err := NewInstancer(path, InstancerOptions{Selector: selector}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	ch := make(chan EntryEvent, 1)
+	instancer.RegisterEntries(ch)
+	defer instancer.DeregisterEntries(ch)
+	want := []Entry{{Instance: "127.0.0.1:8080", Metadata: map[string]string{"zone": "a"}}}
+	if event := <-ch; event.Err != nil || !reflect.DeepEqual(want, event.Entries) {
+		t.Fatalf("want %v, got %v", want, event)
+	}
+
+	// Updated
+	err = writeFile(path, []byte("instances: [{instance: 127.0.0.1:8082, metadata: {zone: a, version: v2}}]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Entry{{Instance: "127.0.0.1:8082", Metadata: map[string]string{"zone": "a", "version": "v2"}}}
+	select {
+	case event := <-ch:
+		if event.Err != nil || !reflect.DeepEqual(want, event.Entries) {
+			t.Fatalf("want %v, got %v", want, event)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the entries")
+	}
+	if event := instancer.EntryState(); !reflect.DeepEqual(want, event.Entries) {
+		t.Fatalf("want %v, got %v", want, event)
+	}
+
+	// Removed
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-ch:
+		if !os.IsNotExist(event.Err) || len(event.Entries) != 0 {
+			t.Fatalf("want not exist error, got %v", event)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the error")
+	}
+}
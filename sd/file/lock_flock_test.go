@@ -0,0 +1,49 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-sd-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".instances.json.lock")
+
+	unlock, err := lockFile(path, defaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is taken by another open file, the same as by another process
+	locked := make(chan func())
+	go func() {
+		unlock, err := lockFile(path, defaultFileMode)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("want blocked by the lock held")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(time.Second):
+		t.Fatal("want locked after released")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package file
+
+import (
+	"os"
+)
+
+// lockFile does nothing on the platforms without flock,
+// the updates are serialized in the process only.
+func lockFile(path string, mode os.FileMode) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,159 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+)
+
+const defaultFileMode os.FileMode = 0644
+
+// RegistrarOptions is used to customize the registrar.
+type RegistrarOptions struct {
+	Format   Format      // Format of the file, default FormatAuto
+	FileMode os.FileMode // Permission of the file written, default 0644
+}
+
+// Registrar adds an instance to a JSON or YAML file, and removes it from the file.
+// The file is replaced by renaming a temporary file, so the instancers never read a partial file.
+// The updates are serialized by an advisory lock of the hidden lock file next to the file, such as ".instances.json.lock",
+// so the services of many processes can share the file. The lock file is left in place.
+// On the platforms without flock, such as Windows, the updates are serialized in the process only.
+// The instances of the crashed processes are left in the file.
+type Registrar struct {
+	path  string // Absolute path of the file
+	entry Entry
+	opts  RegistrarOptions
+
+	logger log.Logger
+}
+
+// fileLocks serializes the updates of the files in the process, keyed by the absolute paths.
+var fileLocks sync.Map
+
+// NewRegistrar returns a registrar of the entry in the file.
+func NewRegistrar(path string, entry Entry, opts RegistrarOptions, logger log.Logger) (*Registrar, error) {
+	if entry.Instance == "" {
+		return nil, errEmptyInstance
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = defaultFileMode
+	}
+	opts.Format = opts.Format.detect(path)
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Registrar{
+		path:   path,
+		entry:  entry,
+		opts:   opts,
+		logger: logger,
+	}, nil
+}
+
+// Start adds the entry to the file, or replaces the entry of the same instance. The file is created if missing.
+func (registrar *Registrar) Start() error {
+	return registrar.update(func(entries []Entry) []Entry {
+		entries = removeEntry(entries, registrar.entry.Instance)
+		return append(entries, registrar.entry)
+	})
+}
+
+// Stop removes the entry from the file.
+func (registrar *Registrar) Stop() error {
+	return registrar.update(func(entries []Entry) []Entry {
+		return removeEntry(entries, registrar.entry.Instance)
+	})
+}
+
+// Register implements sd.Registrar. The failures are logged.
+func (registrar *Registrar) Register() {
+	if err := registrar.Start(); err != nil {
+		registrar.logger.Log("action", "register", "file", registrar.path, "err", err)
+	}
+}
+
+// Deregister implements sd.Registrar. The failures are logged.
+func (registrar *Registrar) Deregister() {
+	if err := registrar.Stop(); err != nil {
+		registrar.logger.Log("action", "deregister", "file", registrar.path, "err", err)
+	}
+}
+
+// update reads the entries of the file, and writes the entries modified.
+func (registrar *Registrar) update(modify func(entries []Entry) []Entry) error {
+	lock, _ := fileLocks.LoadOrStore(registrar.path, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// The other processes updating the file
+	unlock, err := lockFile(lockPath(registrar.path), registrar.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var entries []Entry
+	data, err := ioutil.ReadFile(registrar.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		entries, err = decode(data, registrar.opts.Format)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err = encode(modify(entries), registrar.opts.Format)
+	if err != nil {
+		return err
+	}
+	return writeFile(registrar.path, data, registrar.opts.FileMode)
+}
+
+// lockPath returns the path of the lock file of the file.
+func lockPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".lock")
+}
+
+// writeFile replaces the file by renaming a temporary file in the same directory.
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after renamed
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// removeEntry returns the entries without the instance.
+func removeEntry(entries []Entry, instance string) []Entry {
+	result := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Instance != instance {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
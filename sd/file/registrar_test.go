@@ -0,0 +1,75 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRegistrar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kit-sd-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instances.json")
+
+	instancer, err := NewInstancer(path, InstancerOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	registrar1, err := NewRegistrar(path, Entry{Instance: "127.0.0.1:8080"}, RegistrarOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar2, err := NewRegistrar(path, Entry{Instance: "127.0.0.1:8081", Metadata: map[string]string{"zone": "a"}}, RegistrarOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := registrar1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := registrar2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := registrar2.Start(); err != nil { // replaced, not duplicated
+		t.Fatal(err)
+	}
+	waitFor(t, "registered", func() bool {
+		return hasInstances(instancer.State(), "127.0.0.1:8080", "127.0.0.1:8081")
+	})
+	if entries := instancer.Entries(); entries[1].Metadata["zone"] != "a" {
+		t.Fatalf("want metadata of %s, got %v", entries[1].Instance, entries[1].Metadata)
+	}
+
+	if err := registrar1.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "deregistered", func() bool {
+		return hasInstances(instancer.State(), "127.0.0.1:8081")
+	})
+	registrar2.Deregister()
+	waitFor(t, "all deregistered", func() bool {
+		return hasInstances(instancer.State())
+	})
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if name := file.Name(); name != filepath.Base(path) && name != filepath.Base(lockPath(path)) {
+			t.Fatalf("want the temporary files removed, got %s", name)
+		}
+	}
+
+	if _, err := NewRegistrar(path, Entry{}, RegistrarOptions{}, log.NewNopLogger()); err == nil {
+		t.Fatal("want error of empty instance, got nil")
+	}
+}
@@ -0,0 +1,55 @@
+package file
+
+import (
+	"github.com/wencan/kit-plugins/sd/internal/labels"
+)
+
+// Selector filters the entries by their metadata.
+type Selector interface {
+	// Matches reports whether the entry should be published.
+	Matches(entry Entry) bool
+}
+
+// SelectorFunc is an adapter to allow the use of ordinary functions as Selector.
+type SelectorFunc func(entry Entry) bool
+
+// Matches calls f(entry).
+func (f SelectorFunc) Matches(entry Entry) bool {
+	return f(entry)
+}
+
+// ParseSelector parses a label selector expression on the metadata, such as "env=prod,version in (v2,v3)".
+// The expression is a comma separated list of requirements, which must all be satisfied:
+//
+//	key=value, key==value  the metadata key is present with the value
+//	key!=value             the metadata key is absent or has another value
+//	key in (v1,v2)         the metadata key is present with one of the values
+//	key notin (v1,v2)      the metadata key is absent or has none of the values
+//	key                    the metadata key is present
+//	!key                   the metadata key is absent
+func ParseSelector(expr string) (Selector, error) {
+	selector, err := labels.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	return labelSelector{selector}, nil
+}
+
+// labelSelector is a Selector parsed from a label selector expression.
+type labelSelector struct {
+	selector labels.Selector
+}
+
+// Matches implements Selector.
+func (s labelSelector) Matches(entry Entry) bool {
+	return s.selector.Matches(entry.Metadata)
+}
+
+// unmatched returns the first requirement the entry does not satisfy.
+func (s labelSelector) unmatched(entry Entry) (labels.Requirement, bool) {
+	return s.selector.Unmatched(entry.Metadata)
+}
+
+func (s labelSelector) String() string {
+	return s.selector.String()
+}
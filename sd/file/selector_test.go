@@ -0,0 +1,35 @@
+package file
+
+import (
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	entry := Entry{Instance: "127.0.0.1:8080", Metadata: map[string]string{"zone": "a", "version": "v2"}}
+
+	for _, testcase := range []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"zone=a", true},
+		{"zone!=a", false},
+		{"zone=a,version in (v2,v3)", true},
+		{"version notin (v2)", false},
+		{"canary", false},
+		{"!canary", true},
+	} {
+		selector, err := ParseSelector(testcase.expr)
+		if err != nil {
+			t.Errorf("expr: %q err: %v", testcase.expr, err)
+			continue
+		}
+		if have := selector.Matches(entry); testcase.want != have {
+			t.Errorf("expr: %q want: %v have: %v", testcase.expr, testcase.want, have)
+		}
+	}
+
+	if _, err := ParseSelector("zone in a"); err == nil {
+		t.Error("want error of the invalid selector")
+	}
+}
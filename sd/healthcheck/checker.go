@@ -0,0 +1,66 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Checker checks the health of an instance.
+type Checker interface {
+	Check(ctx context.Context, instance string) error
+}
+
+// CheckerFunc is an adapter to allow the use of ordinary functions as Checkers.
+type CheckerFunc func(ctx context.Context, instance string) error
+
+// Check calls f(ctx, instance).
+func (f CheckerFunc) Check(ctx context.Context, instance string) error {
+	return f(ctx, instance)
+}
+
+// TCPChecker returns a checker which connects to the instances, such as "127.0.0.1:8080".
+// The instances accepting the connections are healthy.
+func TCPChecker() Checker {
+	return CheckerFunc(func(ctx context.Context, instance string) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", instance)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// HTTPChecker returns a checker which gets the path of the instances by the client, http.DefaultClient if nil.
+// The instances are requested as "scheme://instance/path", or "instance/path" if they are URLs already.
+// The instances responding with 2xx status codes are healthy.
+func HTTPChecker(client *http.Client, scheme, path string) Checker {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return CheckerFunc(func(ctx context.Context, instance string) error {
+		url := instance + path
+		if !strings.Contains(instance, "://") {
+			url = scheme + "://" + url
+		}
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unhealthy status: %s", resp.Status)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+package healthcheck
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTCPChecker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	checker := TCPChecker()
+	if err := checker.Check(context.Background(), ln.Addr().String()); err != nil {
+		t.Fatalf("want healthy, got %v", err)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if err := checker.Check(context.Background(), closed.Addr().String()); err == nil {
+		t.Fatal("want unhealthy, got healthy")
+	}
+}
+
+func TestHTTPChecker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, c := range []struct {
+		instance string
+		path     string
+		healthy  bool
+	}{
+		{instance: host, path: "/health", healthy: true},
+		{instance: host, path: "health", healthy: true},
+		{instance: server.URL, path: "/health", healthy: true},
+		{instance: host, path: "/", healthy: false},
+	} {
+		err := HTTPChecker(nil, "http", c.path).Check(context.Background(), c.instance)
+		if healthy := err == nil; healthy != c.healthy {
+			t.Errorf("%s%s: want healthy %v, got %v", c.instance, c.path, c.healthy, err)
+		}
+	}
+}
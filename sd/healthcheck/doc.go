@@ -0,0 +1,5 @@
+// Package healthcheck provides an Instancer wrapping any sd.Instancer, such as the mdns Instancer,
+// which checks the instances by TCP connections or HTTP requests, and publishes only the healthy instances.
+// An instance is marked up after consecutive successful checks, and down after consecutive failed checks,
+// see Options.HealthyThreshold and Options.UnhealthyThreshold.
+package healthcheck
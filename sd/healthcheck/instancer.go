@@ -0,0 +1,218 @@
+package healthcheck
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+
+	"github.com/wencan/kit-plugins/sd/instance"
+)
+
+const (
+	defaultInterval           = time.Second * 10
+	defaultTimeout            = time.Second * 2
+	defaultHealthyThreshold   = 1
+	defaultUnhealthyThreshold = 2
+)
+
+// Options is used to customize the health checks.
+type Options struct {
+	Interval           time.Duration // Interval of the checks, default 10 seconds
+	Timeout            time.Duration // Timeout of a check, default 2 seconds
+	HealthyThreshold   int           // Consecutive successes to mark an instance up, default 1
+	UnhealthyThreshold int           // Consecutive failures to mark an instance down, default 2
+}
+
+// Instancer wraps an sd.Instancer, and publishes only the healthy instances.
+// The new instances are checked at once, and published after they are marked up.
+// The errors of the wrapped instancer are passed through.
+type Instancer struct {
+	instancer sd.Instancer
+	checker   Checker
+	opts      Options
+
+	events chan sd.Event
+	states map[string]*state // Keyed by the instances of the wrapped instancer
+	err    error             // Error of the wrapped instancer
+
+	cache *instance.Cache
+
+	logger log.Logger
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// state is the health of an instance.
+type state struct {
+	up        bool
+	successes int // Consecutive successes
+	failures  int // Consecutive failures
+}
+
+// NewInstancer returns an instancer checking the instances of the wrapped instancer.
+// Stopping the returned instancer does not stop the wrapped instancer.
+func NewInstancer(instancer sd.Instancer, checker Checker, opts Options, logger log.Logger) *Instancer {
+	if opts.Interval == 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.HealthyThreshold == 0 {
+		opts.HealthyThreshold = defaultHealthyThreshold
+	}
+	if opts.UnhealthyThreshold == 0 {
+		opts.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	inst := &Instancer{
+		instancer: instancer,
+		checker:   checker,
+		opts:      opts,
+		events:    make(chan sd.Event, 1),
+		states:    map[string]*state{},
+		cache:     instance.NewCache(),
+		logger:    logger,
+		quit:      make(chan struct{}),
+	}
+
+	// The current state is pushed to the channel at once, checked before returning.
+	instancer.Register(inst.events)
+	inst.update(<-inst.events)
+
+	inst.wg.Add(1)
+	go inst.loop()
+	return inst
+}
+
+func (inst *Instancer) loop() {
+	defer inst.wg.Done()
+
+	ticker := time.NewTicker(inst.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-inst.events:
+			inst.update(event)
+		case <-ticker.C:
+			inst.check(inst.instances())
+			inst.publish()
+		case <-inst.quit:
+			return
+		}
+	}
+}
+
+// update applies the event of the wrapped instancer, and checks the new instances.
+func (inst *Instancer) update(event sd.Event) {
+	inst.err = event.Err
+	if event.Err != nil {
+		inst.publish()
+		return
+	}
+
+	current := make(map[string]bool, len(event.Instances))
+	var added []string
+	for _, instance := range event.Instances {
+		current[instance] = true
+		if _, ok := inst.states[instance]; !ok {
+			inst.states[instance] = &state{}
+			added = append(added, instance)
+		}
+	}
+	for instance := range inst.states {
+		if !current[instance] {
+			delete(inst.states, instance)
+		}
+	}
+
+	inst.check(added)
+	inst.publish()
+}
+
+// check checks the instances concurrently, and marks them up or down by the thresholds.
+func (inst *Instancer) check(instances []string) {
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, instance := range instances {
+		wg.Add(1)
+		go func(i int, instance string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), inst.opts.Timeout)
+			defer cancel()
+			errs[i] = inst.checker.Check(ctx, instance)
+		}(i, instance)
+	}
+	wg.Wait()
+
+	for i, instance := range instances {
+		s := inst.states[instance]
+		if errs[i] != nil {
+			s.successes, s.failures = 0, s.failures+1
+			if s.up && s.failures >= inst.opts.UnhealthyThreshold {
+				s.up = false
+				inst.logger.Log("action", "check", "instance", instance, "health", "down", "err", errs[i])
+			}
+		} else {
+			s.successes, s.failures = s.successes+1, 0
+			if !s.up && s.successes >= inst.opts.HealthyThreshold {
+				s.up = true
+				inst.logger.Log("action", "check", "instance", instance, "health", "up")
+			}
+		}
+	}
+}
+
+// instances returns the instances of the wrapped instancer.
+func (inst *Instancer) instances() []string {
+	instances := make([]string, 0, len(inst.states))
+	for instance := range inst.states {
+		instances = append(instances, instance)
+	}
+	return instances
+}
+
+// publish pushes the healthy instances, or the error of the wrapped instancer, to the cache.
+func (inst *Instancer) publish() {
+	if inst.err != nil {
+		inst.cache.Update(sd.Event{Err: inst.err})
+		return
+	}
+
+	instances := make([]string, 0, len(inst.states))
+	for instance, s := range inst.states {
+		if s.up {
+			instances = append(instances, instance)
+		}
+	}
+	inst.cache.Update(sd.Event{Instances: instances})
+}
+
+// Register implements Instancer.
+func (inst *Instancer) Register(ch chan<- sd.Event) {
+	inst.cache.Register(ch)
+}
+
+// Deregister implements Instancer.
+func (inst *Instancer) Deregister(ch chan<- sd.Event) {
+	inst.cache.Deregister(ch)
+}
+
+// State returns the current state of the healthy instances (instances or error) as sd.Event
+func (inst *Instancer) State() sd.Event {
+	return inst.cache.State()
+}
+
+// Stop terminates the Instancer.
+func (inst *Instancer) Stop() {
+	// Deregister before quitting, the loop keeps draining the events meanwhile.
+	inst.instancer.Deregister(inst.events)
+	close(inst.quit)
+	inst.wg.Wait()
+	inst.cache.Stop()
+}
@@ -0,0 +1,165 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+
+	"github.com/wencan/kit-plugins/sd/instance"
+)
+
+// waitFor polls the condition until it is met, or fails the test after a second.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func equalInstances(event sd.Event, want ...string) bool {
+	got := append([]string{}, event.Instances...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) == 0 && len(want) == 0 {
+		return event.Err == nil
+	}
+	return event.Err == nil && reflect.DeepEqual(got, want)
+}
+
+func TestInstancer(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	upstream := instance.NewCache()
+	upstream.Update(sd.Event{Instances: []string{up.Addr().String(), down.Addr().String()}})
+
+	instancer := NewInstancer(upstream, TCPChecker(), Options{
+		Interval: time.Millisecond * 20,
+		Timeout:  time.Millisecond * 100,
+	}, log.NewNopLogger())
+	defer instancer.Stop()
+
+	// The new instances are checked before publishing
+	if state := instancer.State(); !equalInstances(state, up.Addr().String()) {
+		t.Fatalf("want %s, got %v", up.Addr(), state)
+	}
+
+	ch := make(chan sd.Event, 1)
+	instancer.Register(ch)
+	if event := <-ch; !equalInstances(event, up.Addr().String()) {
+		t.Fatalf("want %s, got %v", up.Addr(), event)
+	}
+	instancer.Deregister(ch)
+
+	// The failed instance is marked down
+	up.Close()
+	waitFor(t, "instance down", func() bool {
+		return equalInstances(instancer.State())
+	})
+
+	// The errors are passed through
+	upstream.Update(sd.Event{Err: errors.New("upstream error")})
+	waitFor(t, "upstream error", func() bool {
+		return instancer.State().Err != nil
+	})
+
+	// The removed instances are removed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	upstream.Update(sd.Event{Instances: []string{ln.Addr().String()}})
+	waitFor(t, "new instance", func() bool {
+		return equalInstances(instancer.State(), ln.Addr().String())
+	})
+	upstream.Update(sd.Event{Instances: []string{}})
+	waitFor(t, "instance removed", func() bool {
+		return equalInstances(instancer.State())
+	})
+}
+
+// flappingChecker fails the instances set unhealthy, and counts the checks.
+type flappingChecker struct {
+	mtx       sync.Mutex
+	unhealthy bool
+	checks    int
+}
+
+func (c *flappingChecker) Check(ctx context.Context, instance string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.checks++
+	if c.unhealthy {
+		return errors.New("unhealthy")
+	}
+	return nil
+}
+
+func (c *flappingChecker) set(unhealthy bool) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.unhealthy = unhealthy
+	return c.checks
+}
+
+func (c *flappingChecker) count() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.checks
+}
+
+func TestInstancerThresholds(t *testing.T) {
+	const instanceAddr = "127.0.0.1:8080"
+
+	upstream := instance.NewCache()
+	upstream.Update(sd.Event{Instances: []string{instanceAddr}})
+
+	checker := &flappingChecker{}
+	instancer := NewInstancer(upstream, checker, Options{
+		Interval:           time.Millisecond * 20,
+		HealthyThreshold:   3,
+		UnhealthyThreshold: 2,
+	}, log.NewNopLogger())
+	defer instancer.Stop()
+
+	// Not marked up until the third successful check
+	if state := instancer.State(); !equalInstances(state) {
+		t.Fatalf("want no instances after a check, got %v", state)
+	}
+	waitFor(t, "instance up", func() bool {
+		return equalInstances(instancer.State(), instanceAddr)
+	})
+	if checks := checker.count(); checks < 3 {
+		t.Fatalf("want marked up after 3 checks, got %d checks", checks)
+	}
+
+	// Marked down after the second failed check
+	before := checker.set(true)
+	waitFor(t, "instance down", func() bool {
+		return equalInstances(instancer.State())
+	})
+	if failures := checker.count() - before; failures < 2 {
+		t.Fatalf("want marked down after 2 failures, got %d failures", failures)
+	}
+}
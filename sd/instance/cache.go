@@ -0,0 +1,183 @@
+package instance
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/sd"
+
+	"github.com/wencan/kit-plugins/sd/internal/subscriber"
+)
+
+// Cache keeps track of resource instances provided to it via Update method
+// and implements the Instancer interface
+type Cache struct {
+	mtx       sync.RWMutex
+	state     sd.Event
+	instances []string // The last instances without error, which the diffs are based on
+	reg       registry
+	diffReg   diffRegistry
+	stopped   bool // The channels are not registered after Stop
+}
+
+// NewCache creates a new Cache.
+func NewCache() *Cache {
+	return &Cache{
+		reg:     registry{},
+		diffReg: diffRegistry{},
+	}
+}
+
+// Update receives new instances from service discovery, stores them internally,
+// and notifies all registered listeners.
+func (c *Cache) Update(event sd.Event) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	sort.Strings(event.Instances)
+	if reflect.DeepEqual(c.state, event) {
+		return // no need to broadcast the same instances
+	}
+
+	c.state = event
+	c.reg.broadcast(event)
+
+	if event.Err != nil {
+		// keep the last instances, the diffs after recovering are based on them
+		c.diffReg.broadcast(Diff{Err: event.Err})
+		return
+	}
+	diff := diffInstances(c.instances, event.Instances)
+	c.instances = append([]string{}, event.Instances...)
+	c.diffReg.broadcast(diff)
+}
+
+// State returns the current state of discovery (instances or error) as sd.Event
+func (c *Cache) State() sd.Event {
+	c.mtx.RLock()
+	event := c.state
+	c.mtx.RUnlock()
+	eventCopy := copyEvent(event)
+	return eventCopy
+}
+
+// Stop implements Instancer. It stops delivering to the registered channels,
+// nothing is sent to them after it returns.
+// The cache keeps the updates, and the channels registered later receive the current state only.
+func (c *Cache) Stop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.stopped = true
+	c.reg.stop()
+	c.diffReg.stop()
+}
+
+// Register implements Instancer.
+// The current state is sent to the channel before it returns, without blocking Update meanwhile.
+// The later events are delivered in a separate goroutine, so a slow consumer never blocks Update.
+// If the consumer falls behind, the events not delivered yet are dropped for the latest one.
+func (c *Cache) Register(ch chan<- sd.Event) {
+	event := c.State()
+	// always push the current state to new channels
+	ch <- event
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stopped {
+		return
+	}
+	s := c.reg.register(ch)
+	if !reflect.DeepEqual(c.state, event) {
+		s.Push(copyEvent(c.state)) // updated while sending
+	}
+}
+
+// Deregister implements Instancer.
+// Nothing is sent to the channel after it returns.
+func (c *Cache) Deregister(ch chan<- sd.Event) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.reg.deregister(ch)
+}
+
+// RegisterDiff registers a channel receiving the diffs between consecutive states.
+// Like Register, the current instances are sent to the channel as added before it returns.
+// The later diffs are delivered in a separate goroutine, and the diffs not delivered yet are merged into one.
+func (c *Cache) RegisterDiff(ch chan<- Diff) {
+	c.mtx.RLock()
+	diff := Diff{Added: append([]string{}, c.instances...), Err: c.state.Err}
+	c.mtx.RUnlock()
+	// always push the current state to new channels
+	ch <- diff
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stopped {
+		return
+	}
+	s := c.diffReg.register(ch)
+	if next := diffInstances(diff.Added, c.instances); next.Added != nil || next.Removed != nil || !reflect.DeepEqual(c.state.Err, diff.Err) {
+		next.Err = c.state.Err
+		s.Push(next) // updated while sending
+	}
+}
+
+// DeregisterDiff deregisters a channel registered by RegisterDiff.
+// Nothing is sent to the channel after it returns.
+func (c *Cache) DeregisterDiff(ch chan<- Diff) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.diffReg.deregister(ch)
+}
+
+// registry is not goroutine-safe.
+type registry map[chan<- sd.Event]*subscriber.Subscriber
+
+func (r registry) broadcast(event sd.Event) {
+	for _, s := range r {
+		eventCopy := copyEvent(event)
+		s.Push(eventCopy)
+	}
+}
+
+func (r registry) register(c chan<- sd.Event) *subscriber.Subscriber {
+	if s, ok := r[c]; ok {
+		return s // registered already
+	}
+	s := subscriber.New(func(value interface{}, quit <-chan struct{}) {
+		select {
+		case c <- value.(sd.Event):
+		case <-quit:
+		}
+	}, subscriber.Latest)
+	r[c] = s
+	return s
+}
+
+func (r registry) deregister(c chan<- sd.Event) {
+	if s, ok := r[c]; ok {
+		s.Stop()
+		delete(r, c)
+	}
+}
+
+func (r registry) stop() {
+	for c := range r {
+		r.deregister(c)
+	}
+}
+
+// copyEvent does a deep copy on sd.Event
+func copyEvent(e sd.Event) sd.Event {
+	// observers all need their own copy of event
+	// because they can directly modify event.Instances
+	// for example, by calling sort.Strings
+	if e.Instances == nil {
+		return e
+	}
+	instances := make([]string, len(e.Instances))
+	copy(instances, e.Instances)
+	e.Instances = instances
+	return e
+}
@@ -0,0 +1,140 @@
+package instance
+
+import (
+	"sort"
+
+	"github.com/wencan/kit-plugins/sd/internal/subscriber"
+)
+
+// Diff is the change of the instances between consecutive states of a Cache.
+// An error does not change the instances, the instances before the error are kept,
+// and the diff after recovering is based on them. So a transient error does not flush the instances.
+// But a Diff with an error may still carry the changes pending before it, coalesced for a subscriber falling behind,
+// so Added and Removed are always to be applied, whether Err is set or not.
+// A Diff without any change and error reports the recovery from an error.
+type Diff struct {
+	Added   []string // Sorted instances added
+	Removed []string // Sorted instances removed
+	Err     error    // Error of the current state
+}
+
+// diffInstances returns the diff from the old to the new instances, both sorted.
+func diffInstances(old, new []string) Diff {
+	var diff Diff
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case j == len(new) || (i < len(old) && old[i] < new[j]):
+			diff.Removed = append(diff.Removed, old[i])
+			i++
+		case i == len(old) || new[j] < old[i]:
+			diff.Added = append(diff.Added, new[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return diff
+}
+
+// Apply applies the diff to the sorted instances, returns the sorted instances after the diff.
+// The instances are not modified.
+func (d Diff) Apply(instances []string) []string {
+	removed := make(map[string]bool, len(d.Removed))
+	for _, instance := range d.Removed {
+		removed[instance] = true
+	}
+	result := make([]string, 0, len(instances)+len(d.Added))
+	for _, instance := range instances {
+		if !removed[instance] {
+			result = append(result, instance)
+		}
+	}
+	result = append(result, d.Added...)
+	sort.Strings(result)
+	return result
+}
+
+// merge returns the diff equal to applying the diff and then the next diff.
+// The error of the next diff is kept.
+func (d Diff) merge(next Diff) Diff {
+	added := make(map[string]bool, len(d.Added)+len(next.Added))
+	removed := make(map[string]bool, len(d.Removed)+len(next.Removed))
+	for _, instance := range d.Added {
+		added[instance] = true
+	}
+	for _, instance := range d.Removed {
+		removed[instance] = true
+	}
+	for _, instance := range next.Added {
+		if removed[instance] {
+			delete(removed, instance) // removed and added back
+		} else {
+			added[instance] = true
+		}
+	}
+	for _, instance := range next.Removed {
+		if added[instance] {
+			delete(added, instance) // added and removed again
+		} else {
+			removed[instance] = true
+		}
+	}
+	return Diff{Added: sortedKeys(added), Removed: sortedKeys(removed), Err: next.Err}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffRegistry is not goroutine-safe.
+type diffRegistry map[chan<- Diff]*subscriber.Subscriber
+
+func (r diffRegistry) broadcast(diff Diff) {
+	for _, s := range r {
+		// observers all need their own copy
+		s.Push(Diff{
+			Added:   append([]string(nil), diff.Added...),
+			Removed: append([]string(nil), diff.Removed...),
+			Err:     diff.Err,
+		})
+	}
+}
+
+func (r diffRegistry) register(c chan<- Diff) *subscriber.Subscriber {
+	if s, ok := r[c]; ok {
+		return s // registered already
+	}
+	s := subscriber.New(func(value interface{}, quit <-chan struct{}) {
+		select {
+		case c <- value.(Diff):
+		case <-quit:
+		}
+	}, func(pending, next interface{}) interface{} {
+		return pending.(Diff).merge(next.(Diff))
+	})
+	r[c] = s
+	return s
+}
+
+func (r diffRegistry) deregister(c chan<- Diff) {
+	if s, ok := r[c]; ok {
+		s.Stop()
+		delete(r, c)
+	}
+}
+
+func (r diffRegistry) stop() {
+	for c := range r {
+		r.deregister(c)
+	}
+}
@@ -0,0 +1,46 @@
+package instance
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDiffInstances(t *testing.T) {
+	for _, c := range []struct {
+		old, new []string
+		want     Diff
+	}{
+		{old: nil, new: nil, want: Diff{}},
+		{old: nil, new: []string{"a", "b"}, want: Diff{Added: []string{"a", "b"}}},
+		{old: []string{"a", "b"}, new: nil, want: Diff{Removed: []string{"a", "b"}}},
+		{old: []string{"a", "b"}, new: []string{"a", "b"}, want: Diff{}},
+		{old: []string{"a", "c", "e"}, new: []string{"b", "c", "d"}, want: Diff{Added: []string{"b", "d"}, Removed: []string{"a", "e"}}},
+	} {
+		diff := diffInstances(c.old, c.new)
+		if !reflect.DeepEqual(c.want, diff) {
+			t.Errorf("%v -> %v: want %+v, have %+v", c.old, c.new, c.want, diff)
+		}
+		if applied := diff.Apply(c.old); !(len(applied) == 0 && len(c.new) == 0) && !reflect.DeepEqual(c.new, applied) {
+			t.Errorf("%v -> %v: applied %v", c.old, c.new, applied)
+		}
+	}
+}
+
+func TestDiffMerge(t *testing.T) {
+	err := errors.New("discovery error")
+	for _, c := range []struct {
+		diff, next Diff
+		want       Diff
+	}{
+		{diff: Diff{Added: []string{"a"}}, next: Diff{Added: []string{"b"}}, want: Diff{Added: []string{"a", "b"}}},
+		{diff: Diff{Added: []string{"a"}}, next: Diff{Removed: []string{"a"}}, want: Diff{}},
+		{diff: Diff{Removed: []string{"a"}}, next: Diff{Added: []string{"a"}}, want: Diff{}},
+		{diff: Diff{Removed: []string{"a"}}, next: Diff{Err: err}, want: Diff{Removed: []string{"a"}, Err: err}},
+		{diff: Diff{Err: err}, next: Diff{Added: []string{"b"}}, want: Diff{Added: []string{"b"}}},
+	} {
+		if merged := c.diff.merge(c.next); !reflect.DeepEqual(c.want, merged) {
+			t.Errorf("%+v + %+v: want %+v, have %+v", c.diff, c.next, c.want, merged)
+		}
+	}
+}
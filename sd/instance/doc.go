@@ -0,0 +1,5 @@
+// Package instance provides a Cache keeping track of the instances of a service, which implements sd.Instancer.
+// It is a building block of the discovery backends, which update the cache with the instances discovered.
+// Besides the full snapshots of sd.Event, the cache delivers the diffs between consecutive states,
+// see Cache.RegisterDiff.
+package instance
@@ -0,0 +1,175 @@
+// Package labels parses and matches the label selector expressions of the instancers,
+// such as "env=prod,version in (v2,v3)".
+package labels
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	setRequirementRegexp     = regexp.MustCompile(`^([^\s!=(),]+)\s+(in|notin)\s*\(([^()]*)\)$`)
+	compareRequirementRegexp = regexp.MustCompile(`^([^\s!=(),]+)\s*(==|=|!=)\s*([^\s!=(),]*)$`)
+	existsRequirementRegexp  = regexp.MustCompile(`^(!?)\s*([^\s!=(),]+)$`)
+)
+
+// Parse parses a label selector expression, such as "env=prod,version in (v2,v3)".
+// The expression is a comma separated list of requirements, which must all be satisfied:
+//
+//	key=value, key==value  the key is present with the value
+//	key!=value             the key is absent or has another value
+//	key in (v1,v2)         the key is present with one of the values
+//	key notin (v1,v2)      the key is absent or has none of the values
+//	key                    the key is present
+//	!key                   the key is absent
+func Parse(expr string) (Selector, error) {
+	var selector Selector
+	if strings.TrimSpace(expr) == "" {
+		return selector, nil // matches everything
+	}
+	for _, part := range splitRequirements(expr) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("invalid selector %q: empty requirement", expr)
+		}
+
+		if matches := setRequirementRegexp.FindStringSubmatch(part); matches != nil {
+			values := strings.Split(matches[3], ",")
+			for i := range values {
+				values[i] = strings.TrimSpace(values[i])
+				if values[i] == "" {
+					return nil, fmt.Errorf("invalid selector %q: empty value in %q", expr, part)
+				}
+			}
+			operator := operatorIn
+			if matches[2] == "notin" {
+				operator = operatorNotIn
+			}
+			selector = append(selector, Requirement{key: matches[1], operator: operator, values: values})
+		} else if matches := compareRequirementRegexp.FindStringSubmatch(part); matches != nil {
+			operator := operatorIn
+			if matches[2] == "!=" {
+				operator = operatorNotIn
+			}
+			selector = append(selector, Requirement{key: matches[1], operator: operator, values: []string{matches[3]}})
+		} else if matches := existsRequirementRegexp.FindStringSubmatch(part); matches != nil {
+			operator := operatorExists
+			if matches[1] == "!" {
+				operator = operatorNotExists
+			}
+			selector = append(selector, Requirement{key: matches[2], operator: operator})
+		} else {
+			return nil, fmt.Errorf("invalid selector %q: unexpected requirement %q", expr, part)
+		}
+	}
+	return selector, nil
+}
+
+// splitRequirements splits the expression at the commas outside of parentheses.
+func splitRequirements(expr string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range expr {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+type operator int
+
+const (
+	operatorIn operator = iota
+	operatorNotIn
+	operatorExists
+	operatorNotExists
+)
+
+// Requirement is a requirement of a selector, such as "env=prod".
+type Requirement struct {
+	key      string
+	operator operator
+	values   []string
+}
+
+func (r Requirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.operator {
+	case operatorIn:
+		return ok && r.has(value)
+	case operatorNotIn:
+		return !ok || !r.has(value)
+	case operatorExists:
+		return ok
+	case operatorNotExists:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func (r Requirement) has(value string) bool {
+	for _, v := range r.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Requirement) String() string {
+	switch r.operator {
+	case operatorIn:
+		if len(r.values) == 1 {
+			return r.key + "=" + r.values[0]
+		}
+		return r.key + " in (" + strings.Join(r.values, ",") + ")"
+	case operatorNotIn:
+		if len(r.values) == 1 {
+			return r.key + "!=" + r.values[0]
+		}
+		return r.key + " notin (" + strings.Join(r.values, ",") + ")"
+	case operatorNotExists:
+		return "!" + r.key
+	default:
+		return r.key
+	}
+}
+
+// Selector is a list of requirements, which must all be satisfied.
+// The empty selector matches everything.
+type Selector []Requirement
+
+// Matches reports whether the labels satisfy all the requirements.
+func (s Selector) Matches(labels map[string]string) bool {
+	_, ok := s.Unmatched(labels)
+	return !ok
+}
+
+// Unmatched returns the first requirement the labels do not satisfy.
+func (s Selector) Unmatched(labels map[string]string) (Requirement, bool) {
+	for _, r := range s {
+		if !r.matches(labels) {
+			return r, true
+		}
+	}
+	return Requirement{}, false
+}
+
+func (s Selector) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
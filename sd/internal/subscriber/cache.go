@@ -0,0 +1,94 @@
+package subscriber
+
+import (
+	"reflect"
+	"sync"
+)
+
+// CopyFunc returns a deep copy of the state, the consumers can modify the copies they received.
+type CopyFunc func(state interface{}) interface{}
+
+// Cache keeps the latest state, and delivers it to the registered consumers, each by its own Subscriber.
+// The consumers falling behind receive the latest state only.
+type Cache struct {
+	mtx     sync.RWMutex
+	state   interface{}
+	copy    CopyFunc
+	reg     map[interface{}]*Subscriber // Keyed by the consumers, such as their channels
+	stopped bool                        // The consumers are not registered after Stop
+}
+
+// NewCache returns a cache of the initial state.
+func NewCache(state interface{}, copy CopyFunc) *Cache {
+	return &Cache{
+		state: state,
+		copy:  copy,
+		reg:   map[interface{}]*Subscriber{},
+	}
+}
+
+// Update stores the state, and queues it to the consumers without blocking.
+// The state equal to the current one is ignored.
+func (c *Cache) Update(state interface{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if reflect.DeepEqual(c.state, state) {
+		return // no need to broadcast the same state
+	}
+	c.state = state
+	for _, s := range c.reg {
+		s.Push(c.copy(state))
+	}
+}
+
+// State returns a copy of the current state.
+func (c *Cache) State() interface{} {
+	c.mtx.RLock()
+	state := c.state
+	c.mtx.RUnlock()
+	return c.copy(state)
+}
+
+// Register sends the current state to the consumer before it returns, without blocking Update meanwhile,
+// and then delivers the later states in a separate goroutine. The quit channel of the first send is nil.
+func (c *Cache) Register(key interface{}, send SendFunc) {
+	state := c.State()
+	// always push the current state to new consumers
+	send(state, nil)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stopped {
+		return
+	}
+	s, ok := c.reg[key]
+	if !ok {
+		s = New(send, Latest)
+		c.reg[key] = s
+	}
+	if !reflect.DeepEqual(c.state, state) {
+		s.Push(c.copy(c.state)) // updated while sending
+	}
+}
+
+// Deregister deregisters the consumer, nothing is sent to it after Deregister returns.
+func (c *Cache) Deregister(key interface{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if s, ok := c.reg[key]; ok {
+		s.Stop()
+		delete(c.reg, key)
+	}
+}
+
+// Stop stops delivering to the registered consumers, nothing is sent to them after it returns.
+func (c *Cache) Stop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.stopped = true
+	for key, s := range c.reg {
+		s.Stop()
+		delete(c.reg, key)
+	}
+}
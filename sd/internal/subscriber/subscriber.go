@@ -0,0 +1,84 @@
+// Package subscriber delivers the states of the caches to their subscribers,
+// every subscriber in its own goroutine, so a slow consumer never blocks the others.
+package subscriber
+
+import "sync"
+
+// SendFunc sends the value to the consumer, it gives up when quit is closed.
+type SendFunc func(value interface{}, quit <-chan struct{})
+
+// MergeFunc coalesces the value not delivered yet and the next value.
+type MergeFunc func(pending, next interface{}) interface{}
+
+// Latest is a MergeFunc keeping only the latest value.
+func Latest(pending, next interface{}) interface{} {
+	return next
+}
+
+// Subscriber delivers the values to a consumer in its own goroutine.
+// The values not delivered yet are coalesced, the consumer receives the latest state only.
+type Subscriber struct {
+	mtx     sync.Mutex
+	pending interface{} // The value not delivered yet, nil if none
+	merge   MergeFunc
+	send    SendFunc
+
+	notify chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// New starts delivering by send, the pending value and the next value are coalesced by merge.
+func New(send SendFunc, merge MergeFunc) *Subscriber {
+	s := &Subscriber{
+		merge:  merge,
+		send:   send,
+		notify: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+// Push queues the value without blocking.
+func (s *Subscriber) Push(value interface{}) {
+	s.mtx.Lock()
+	if s.pending == nil {
+		s.pending = value
+	} else {
+		s.pending = s.merge(s.pending, value)
+	}
+	s.mtx.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default: // notified already
+	}
+}
+
+func (s *Subscriber) loop() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.notify:
+		case <-s.quit:
+			return
+		}
+
+		s.mtx.Lock()
+		value := s.pending
+		s.pending = nil
+		s.mtx.Unlock()
+
+		if value != nil {
+			s.send(value, s.quit)
+		}
+	}
+}
+
+// Stop stops delivering, nothing is sent to the consumer after it returns.
+func (s *Subscriber) Stop() {
+	close(s.quit)
+	<-s.done
+}
@@ -0,0 +1,113 @@
+package mdns
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path"
+	"sort"
+	"time"
+)
+
+const defaultWatchInterval = time.Second * 10
+
+// ErrNoAddresses is returned when no interface address is accepted by the AddressOptions.
+var ErrNoAddresses = errors.New("mdns: no addresses found on the interfaces")
+
+// AddressOptions is used to enumerate the addresses of the instance on the interfaces,
+// instead of resolving the host name, which often gives 127.0.1.1 on Debian-based hosts.
+type AddressOptions struct {
+	Interfaces []string // Names of the interfaces to enumerate, default all the interfaces up
+	Exclude    []string // Names of the interfaces to skip, as patterns of path.Match, such as "docker*"
+	Loopback   bool     // Include the loopback interfaces
+	LinkLocal  bool     // Include the link-local addresses
+
+	// WatchInterval is the interval the addresses are checked for changes, such as DHCP renewals or VPN up/down,
+	// default 10 seconds. The new addresses are announced when changed. Negative disables watching.
+	WatchInterval time.Duration
+}
+
+// discover returns the accepted addresses of the interfaces, sorted.
+func (opts AddressOptions) discover() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if !opts.acceptInterface(iface) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !opts.acceptIP(ipNet.IP) {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, ErrNoAddresses
+	}
+	return sortIPs(ips), nil
+}
+
+// acceptInterface reports whether the addresses of the interface are enumerated.
+func (opts AddressOptions) acceptInterface(iface net.Interface) bool {
+	if iface.Flags&net.FlagUp == 0 {
+		return false
+	}
+	if iface.Flags&net.FlagLoopback != 0 && !opts.Loopback {
+		return false
+	}
+	if len(opts.Interfaces) > 0 && !matchName(opts.Interfaces, iface.Name) {
+		return false
+	}
+	return !matchName(opts.Exclude, iface.Name)
+}
+
+// acceptIP reports whether the address is advertised.
+func (opts AddressOptions) acceptIP(ip net.IP) bool {
+	if ip.IsLoopback() && !opts.Loopback {
+		return false
+	}
+	if ip.IsLinkLocalUnicast() && !opts.LinkLocal {
+		return false
+	}
+	return ip.IsGlobalUnicast() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+func matchName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func sortIPs(ips []net.IP) []net.IP {
+	sorted := append([]net.IP{}, ips...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].To16(), sorted[j].To16()) < 0
+	})
+	return sorted
+}
+
+// equalIPs reports whether the sorted addresses are the same.
+func equalIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddressOptions(t *testing.T) {
+	up := net.FlagUp | net.FlagMulticast
+	tests := []struct {
+		opts  AddressOptions
+		iface net.Interface
+		ip    string
+		want  bool
+	}{
+		{AddressOptions{}, net.Interface{Name: "eth0", Flags: up}, "192.168.1.10", true},
+		{AddressOptions{}, net.Interface{Name: "eth0", Flags: up}, "2001:db8::1", true},
+		{AddressOptions{}, net.Interface{Name: "eth0"}, "192.168.1.10", false},
+		{AddressOptions{}, net.Interface{Name: "eth0", Flags: up}, "fe80::1", false},
+		{AddressOptions{LinkLocal: true}, net.Interface{Name: "eth0", Flags: up}, "fe80::1", true},
+		{AddressOptions{}, net.Interface{Name: "lo", Flags: up | net.FlagLoopback}, "127.0.0.1", false},
+		{AddressOptions{Loopback: true}, net.Interface{Name: "lo", Flags: up | net.FlagLoopback}, "127.0.0.1", true},
+		{AddressOptions{Exclude: []string{"docker*"}}, net.Interface{Name: "docker0", Flags: up}, "172.17.0.1", false},
+		{AddressOptions{Interfaces: []string{"eth0"}}, net.Interface{Name: "wlan0", Flags: up}, "192.168.1.10", false},
+		{AddressOptions{Interfaces: []string{"eth*"}}, net.Interface{Name: "eth1", Flags: up}, "192.168.1.10", true},
+	}
+	for _, test := range tests {
+		have := test.opts.acceptInterface(test.iface) && test.opts.acceptIP(net.ParseIP(test.ip))
+		if have != test.want {
+			t.Errorf("%+v %s %s: want: %v have: %v", test.opts, test.iface.Name, test.ip, test.want, have)
+		}
+	}
+}
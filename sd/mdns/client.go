@@ -0,0 +1,130 @@
+package mdns
+
+import (
+	"net"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/miekg/dns"
+)
+
+// client sends mDNS queries, and receives the responses and the unsolicited announcements.
+type client struct {
+	conns   []*mdnsConn
+	queries bool // Whether the queries of the others are received too
+
+	msgCh  chan *dns.Msg
+	closed chan struct{}
+	wg     sync.WaitGroup
+
+	logger log.Logger
+}
+
+// newClient returns a client sending queries over the transport on the interfaces,
+// uses system default if none is provided.
+// If browse is true, the client also listens on the mDNS groups for the announcements,
+// and if queries is true, for the queries too.
+func newClient(transport Transport, ifaces []*net.Interface, browse, queries bool, logger log.Logger) (*client, error) {
+	conns, err := listenUnicast(transport, ifaces)
+	if err != nil {
+		return nil, err
+	}
+	if browse {
+		multicastConns, err := listenMulticast(transport, ifaces)
+		if err != nil {
+			closeConns(conns)
+			return nil, err
+		}
+		conns = append(conns, multicastConns...)
+	}
+
+	c := &client{
+		conns:   conns,
+		queries: queries,
+		msgCh:   make(chan *dns.Msg, 32),
+		closed:  make(chan struct{}),
+		logger:  logger,
+	}
+	for _, conn := range conns {
+		c.wg.Add(1)
+		go c.recv(conn)
+	}
+	return c, nil
+}
+
+// query multicasts a query with the questions.
+// It succeeds if the query was sent over any IP version.
+func (c *client) query(questions ...dns.Question) error {
+	return c.send(&dns.Msg{
+		Question: questions,
+	})
+}
+
+// send multicasts the query message.
+func (c *client) send(msg *dns.Msg) error {
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	var conns []*mdnsConn
+	for _, conn := range c.conns {
+		if !conn.multicast {
+			conns = append(conns, conn) // queries are sent from the unicast sockets, responders reply there directly
+		}
+	}
+	return sendMulticast(conns, buf)
+}
+
+// messages returns the channel of the received responses.
+func (c *client) messages() <-chan *dns.Msg {
+	return c.msgCh
+}
+
+// recv receives the responses until the client is closed.
+func (c *client) recv(conn *mdnsConn) {
+	defer c.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			c.logger.Log("action", "receive", "err", err)
+			return
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil {
+			c.logger.Log("action", "receive", "err", err)
+			continue
+		}
+		if msg.Opcode != dns.OpcodeQuery || msg.Rcode != dns.RcodeSuccess {
+			continue // not a valid mDNS message, as per 18.3 and 18.11 in RFC
+		}
+		if !msg.Response && !c.queries {
+			continue
+		}
+
+		select {
+		case c.msgCh <- msg:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Close closes the sockets, and waits for the receivers to exit.
+func (c *client) Close() error {
+	close(c.closed)
+	closeConns(c.conns)
+	c.wg.Wait()
+	return nil
+}
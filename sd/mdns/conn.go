@@ -0,0 +1,209 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	ipv4mdns = "224.0.0.251"
+	ipv6mdns = "ff02::fb"
+	mdnsPort = 5353
+)
+
+var (
+	ipv4Group = &net.UDPAddr{
+		IP:   net.ParseIP(ipv4mdns),
+		Port: mdnsPort,
+	}
+	ipv6Group = &net.UDPAddr{
+		IP:   net.ParseIP(ipv6mdns),
+		Port: mdnsPort,
+	}
+)
+
+// mdnsConn is a socket used to talk to the mDNS group of an IP version.
+type mdnsConn struct {
+	net.PacketConn
+	group     *net.UDPAddr // The mDNS group address, for the IP version of the socket
+	multicast bool         // Whether the socket listens on the mDNS port of the group
+}
+
+// Transport opens the sockets mDNS talks over, one for each IP version.
+// UDPTransport is the default transport, which uses the UDP sockets of the host.
+// Other transports, such as the in-memory network of package mdnstest, are used by the tests.
+type Transport interface {
+	// ListenUnicast opens a socket with an ephemeral port, from which the packets to the group are sent
+	// on the interface. The system default interface is used if iface is nil.
+	ListenUnicast(iface *net.Interface, group *net.UDPAddr) (net.PacketConn, error)
+	// ListenMulticast opens a socket joined the group on the interface, which listens on the port of the group.
+	// The packets sent over the socket are also received by the other sockets joined the group on the host.
+	ListenMulticast(iface *net.Interface, group *net.UDPAddr) (net.PacketConn, error)
+}
+
+// UDPTransport is the Transport over the UDP sockets of the host.
+var UDPTransport Transport = udpTransport{}
+
+type udpTransport struct{}
+
+func (udpTransport) ListenUnicast(iface *net.Interface, group *net.UDPAddr) (net.PacketConn, error) {
+	network, laddr, v6 := "udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0}, false
+	if group.IP.To4() == nil {
+		network, laddr, v6 = "udp6", &net.UDPAddr{IP: net.IPv6zero, Port: 0}, true
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := setMulticastInterface(conn, iface, v6); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (udpTransport) ListenMulticast(iface *net.Interface, group *net.UDPAddr) (net.PacketConn, error) {
+	// The multicast loopback is disabled by net.ListenMulticastUDP,
+	// but the other processes on this host need to hear what we send.
+	if group.IP.To4() != nil {
+		conn, err := net.ListenMulticastUDP("udp4", iface, group)
+		if err != nil {
+			return nil, err
+		}
+		if err := ipv4.NewPacketConn(conn).SetMulticastLoopback(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	conn, err := net.ListenMulticastUDP("udp6", iface, group)
+	if err != nil {
+		return nil, err
+	}
+	if err := ipv6.NewPacketConn(conn).SetMulticastLoopback(true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// defaultTransport returns the transport, or UDPTransport if not provided.
+func defaultTransport(transport Transport) Transport {
+	if transport == nil {
+		return UDPTransport
+	}
+	return transport
+}
+
+// listenUnicast opens the sockets with an ephemeral port on each interface, from which queries are sent.
+// Uses system default interface if none is provided.
+func listenUnicast(transport Transport, ifaces []*net.Interface) ([]*mdnsConn, error) {
+	conns, errs := listen(transport.ListenUnicast, ifaces, false)
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("failed to bind to any unicast udp port: %v", errs)
+	}
+	return conns, nil
+}
+
+// listenMulticast opens the sockets joined the mDNS groups on each interface.
+// Uses system default interface if none is provided.
+func listenMulticast(transport Transport, ifaces []*net.Interface) ([]*mdnsConn, error) {
+	conns, errs := listen(transport.ListenMulticast, ifaces, true)
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("no multicast listeners could be started: %v", errs)
+	}
+	return conns, nil
+}
+
+// listen opens the sockets of both IP versions on each interface.
+func listen(open func(*net.Interface, *net.UDPAddr) (net.PacketConn, error), ifaces []*net.Interface, multicast bool) ([]*mdnsConn, []error) {
+	var conns []*mdnsConn
+	var errs []error
+	for _, iface := range defaultInterfaces(ifaces) {
+		for _, group := range []*net.UDPAddr{ipv4Group, ipv6Group} {
+			conn, err := open(iface, group)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			conns = append(conns, &mdnsConn{PacketConn: conn, group: group, multicast: multicast})
+		}
+	}
+	return conns, errs
+}
+
+// defaultInterfaces returns the interfaces, or the system default interface as nil.
+func defaultInterfaces(ifaces []*net.Interface) []*net.Interface {
+	if len(ifaces) == 0 {
+		return []*net.Interface{nil}
+	}
+	return ifaces
+}
+
+// interfaces returns the interface as a list, empty for system default.
+func interfaces(iface *net.Interface) []*net.Interface {
+	if iface == nil {
+		return nil
+	}
+	return []*net.Interface{iface}
+}
+
+// multicastInterfaces returns all the multicast-capable interfaces up.
+func multicastInterfaces() ([]*net.Interface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []*net.Interface
+	for i := range all {
+		if all[i].Flags&net.FlagUp != 0 && all[i].Flags&net.FlagMulticast != 0 {
+			ifaces = append(ifaces, &all[i])
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("no multicast interfaces found")
+	}
+	return ifaces, nil
+}
+
+// setMulticastInterface sets the interface outgoing multicast packets are sent on,
+// uses system default if not provided.
+func setMulticastInterface(conn *net.UDPConn, iface *net.Interface, v6 bool) error {
+	if iface == nil {
+		return nil
+	}
+	if v6 {
+		return ipv6.NewPacketConn(conn).SetMulticastInterface(iface)
+	}
+	return ipv4.NewPacketConn(conn).SetMulticastInterface(iface)
+}
+
+// sendMulticast sends the packet to the mDNS groups from the sockets.
+// It succeeds if the packet was sent over any socket.
+func sendMulticast(conns []*mdnsConn, buf []byte) error {
+	var sent int
+	var errs []error
+	for _, conn := range conns {
+		if _, err := conn.WriteTo(buf, conn.group); err != nil {
+			errs = append(errs, err)
+		} else {
+			sent++
+		}
+	}
+	if sent == 0 {
+		return fmt.Errorf("failed to send multicast packet: %v", errs)
+	}
+	return nil
+}
+
+// closeConns closes all the sockets.
+func closeConns(conns []*mdnsConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
@@ -3,4 +3,6 @@
 // discovery. It is important to note that many networks restrict the use of multicasting, which prevents mDNS from
 // functioning. Notably, multicast cannot be used in any sort of cloud, or shared infrastructure environment.
 // However it works well in most office, home, or private infrastructure environments.
+// In the other environments, the Instancer can look up the services over unicast DNS-SD,
+// see InstancerOptions.UnicastServer.
 package mdns
@@ -0,0 +1,138 @@
+package mdns
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+
+	"github.com/wencan/kit-plugins/sd/internal/subscriber"
+)
+
+// Entry is a discovered service instance with its mDNS metadata.
+type Entry struct {
+	Instance string            // Instance address, as published through sd.Event
+	Name     string            // Service instance name, without the service and domain
+	Host     string            // Host name of the instance
+	AddrV4   net.IP            // IPv4 address of the host, if any
+	AddrV6   net.IP            // IPv6 address of the host, if any
+	Port     int               // Service port
+	Txt      map[string]string // TXT key/value pairs
+}
+
+// EntryEvent represents a push notification of discovered entries.
+// It is the metadata-aware counterpart of sd.Event.
+type EntryEvent struct {
+	Entries []Entry
+	Err     error
+}
+
+// newEntry get the entry from mdns.ServiceEntry, the instance address is left to the caller.
+func newEntry(serviceEntry *mdns.ServiceEntry, serviceAddr string) Entry {
+	// The names unpacked are escaped, such as "node1\ \(2\)", the instance names are not.
+	name := serviceEntry.Name
+	labels := dns.SplitDomainName(name)
+	if n := len(labels) - dns.CountLabel(serviceAddr); n > 0 && equalNames(strings.Join(labels[n:], "."), serviceAddr) {
+		name = strings.Join(labels[:n], ".")
+	}
+
+	return Entry{
+		Name:   unescapeName(name),
+		Host:   serviceEntry.Host,
+		AddrV4: serviceEntry.AddrV4,
+		AddrV6: serviceEntry.AddrV6,
+		Port:   serviceEntry.Port,
+		Txt:    parseTxt(serviceEntry.InfoFields),
+	}
+}
+
+// parseTxt parses TXT strings into key/value pairs, as per section 6 of RFC 6763.
+// Keys without value are mapped to empty strings, and only the first occurrence of a key is used.
+func parseTxt(txt []string) map[string]string {
+	fields := make(map[string]string, len(txt))
+	for _, field := range txt {
+		key, value := field, ""
+		if i := strings.IndexByte(field, '='); i >= 0 {
+			key, value = field[:i], field[i+1:]
+		}
+		if key == "" {
+			continue // strings beginning with '=' are silently ignored
+		}
+		if _, ok := fields[key]; ok {
+			continue
+		}
+		fields[key] = value
+	}
+	return fields
+}
+
+// entryCache keeps track of the entries provided to it via update method,
+// and notifies all registered listeners, the same as instance.Cache.
+type entryCache struct {
+	cache *subscriber.Cache
+}
+
+func newEntryCache() *entryCache {
+	return &entryCache{
+		cache: subscriber.NewCache(EntryEvent{}, func(state interface{}) interface{} {
+			return copyEntryEvent(state.(EntryEvent))
+		}),
+	}
+}
+
+// update stores the entries, and queues them to the listeners without blocking.
+func (c *entryCache) update(event EntryEvent) {
+	sort.Slice(event.Entries, func(i, j int) bool {
+		if event.Entries[i].Instance != event.Entries[j].Instance {
+			return event.Entries[i].Instance < event.Entries[j].Instance
+		}
+		return event.Entries[i].Name < event.Entries[j].Name
+	})
+	c.cache.Update(event)
+}
+
+func (c *entryCache) current() EntryEvent {
+	return c.cache.State().(EntryEvent)
+}
+
+// register sends the current state to the channel before it returns, without blocking update meanwhile.
+// The later events are delivered in a separate goroutine, only the latest one if the consumer falls behind.
+func (c *entryCache) register(ch chan<- EntryEvent) {
+	c.cache.Register(ch, func(value interface{}, quit <-chan struct{}) {
+		select {
+		case ch <- value.(EntryEvent):
+		case <-quit:
+		}
+	})
+}
+
+// deregister deregisters the channel, nothing is sent to the channel after it returns.
+func (c *entryCache) deregister(ch chan<- EntryEvent) {
+	c.cache.Deregister(ch)
+}
+
+// stop stops delivering to the registered channels, nothing is sent to them after it returns.
+func (c *entryCache) stop() {
+	c.cache.Stop()
+}
+
+// copyEntryEvent does a deep copy on EntryEvent,
+// observers can modify the entries and TXT maps they received.
+func copyEntryEvent(e EntryEvent) EntryEvent {
+	if e.Entries == nil {
+		return e
+	}
+	entries := make([]Entry, len(e.Entries))
+	for i, entry := range e.Entries {
+		txt := make(map[string]string, len(entry.Txt))
+		for key, value := range entry.Txt {
+			txt[key] = value
+		}
+		entry.Txt = txt
+		entries[i] = entry
+	}
+	e.Entries = entries
+	return e
+}
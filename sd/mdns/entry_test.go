@@ -0,0 +1,103 @@
+package mdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+func TestParseTxt(t *testing.T) {
+	for _, testcase := range []struct {
+		txt  []string
+		want map[string]string
+	}{
+		{nil, map[string]string{}},
+		{[]string{"version=v2", "zone=a"}, map[string]string{"version": "v2", "zone": "a"}},
+		{[]string{"canary", "empty="}, map[string]string{"canary": "", "empty": ""}},
+		{[]string{"url=http://a/?b=c"}, map[string]string{"url": "http://a/?b=c"}},
+		{[]string{"=ignored", "zone=a", "zone=b"}, map[string]string{"zone": "a"}},
+	} {
+		if have := parseTxt(testcase.txt); !reflect.DeepEqual(testcase.want, have) {
+			t.Errorf("txt: %q want: %v have: %v", testcase.txt, testcase.want, have)
+		}
+	}
+}
+
+func TestCopyEntryEvent(t *testing.T) {
+	event := EntryEvent{Entries: []Entry{{Instance: "a", Txt: map[string]string{"k": "v"}}}}
+	eventCopy := copyEntryEvent(event)
+	eventCopy.Entries[0].Instance = "b"
+	eventCopy.Entries[0].Txt["k"] = "w"
+
+	if want, have := "a", event.Entries[0].Instance; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+	if want, have := "v", event.Entries[0].Txt["k"]; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
+
+func TestNewEntryName(t *testing.T) {
+	serviceAddr := "_http._tcp.local."
+	for _, testcase := range []struct {
+		name string
+		want string
+	}{
+		{"node1._http._tcp.local.", "node1"},
+		{`node1\ \(2\)._http._tcp.local.`, "node1 (2)"},
+		{`node1\ \(2\)._HTTP._tcp.local.`, "node1 (2)"},
+		{`web\.node._http._tcp.local.`, "web.node"},
+	} {
+		entry := newEntry(&mdns.ServiceEntry{
+			Name:   testcase.name,
+			AddrV4: net.IPv4(127, 0, 0, 1),
+			Port:   8080,
+		}, serviceAddr)
+		if want, have := testcase.want, entry.Name; want != have {
+			t.Errorf("name: %s want: %q have: %q", testcase.name, want, have)
+		}
+	}
+}
+
+func TestEntryCacheSlowSubscriber(t *testing.T) {
+	cache := newEntryCache()
+	stuck := make(chan EntryEvent)
+	go cache.register(stuck)
+
+	ch := make(chan EntryEvent)
+	go cache.register(ch)
+	<-ch
+
+	// A stuck subscriber blocks neither the updates nor the other subscribers
+	for _, instance := range []string{"a", "b", "c"} {
+		done := make(chan struct{})
+		go func() {
+			cache.update(EntryEvent{Entries: []Entry{{Instance: instance}}})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("update blocked by the stuck subscriber")
+		}
+		if want, have := instance, (<-ch).Entries[0].Instance; want != have {
+			t.Errorf("want: %s have: %s", want, have)
+		}
+	}
+
+	// The stuck subscriber receives the state taken at registering, and then the latest state
+	if event := <-stuck; len(event.Entries) == 0 || event.Entries[0].Instance != "c" {
+		if want, have := "c", (<-stuck).Entries[0].Instance; want != have {
+			t.Errorf("want: %s have: %s", want, have)
+		}
+	}
+
+	cache.stop()
+	close(stuck)
+	close(ch)
+	// if stop didn't work, update would panic on the closed channels
+	cache.update(EntryEvent{Entries: []Entry{{Instance: "d"}}})
+}
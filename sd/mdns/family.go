@@ -0,0 +1,59 @@
+package mdns
+
+import (
+	"net"
+	"strconv"
+)
+
+// AddressFamily decides which addresses of the instances are published, when the hosts have both IPv4 and IPv6.
+type AddressFamily int
+
+const (
+	// PreferIPv4 publishes the IPv4 address, or the IPv6 address if the host has no IPv4 address.
+	PreferIPv4 AddressFamily = iota
+	// PreferIPv6 publishes the IPv6 address, or the IPv4 address if the host has no IPv6 address.
+	PreferIPv6
+	// IPv4Only publishes only the IPv4 addresses, the hosts without are skipped.
+	IPv4Only
+	// IPv6Only publishes only the IPv6 addresses, the hosts without are skipped.
+	IPv6Only
+	// BothFamilies publishes both addresses, IPv4 first.
+	BothFamilies
+)
+
+// addresses returns the addresses of the entry to publish, the first is preferred.
+func (family AddressFamily) addresses(entry Entry) []net.IP {
+	switch family {
+	case PreferIPv6:
+		return firstIP(entry.AddrV6, entry.AddrV4)
+	case IPv4Only:
+		return firstIP(entry.AddrV4)
+	case IPv6Only:
+		return firstIP(entry.AddrV6)
+	case BothFamilies:
+		var ips []net.IP
+		for _, ip := range []net.IP{entry.AddrV4, entry.AddrV6} {
+			if ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips
+	default:
+		return firstIP(entry.AddrV4, entry.AddrV6)
+	}
+}
+
+// firstIP returns the first address which is not nil.
+func firstIP(ips ...net.IP) []net.IP {
+	for _, ip := range ips {
+		if ip != nil {
+			return []net.IP{ip}
+		}
+	}
+	return nil
+}
+
+// hostPort returns the instance address, such as "127.0.0.1:8080" or "[::1]:8080".
+func hostPort(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
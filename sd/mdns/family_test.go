@@ -0,0 +1,39 @@
+package mdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAddressFamily(t *testing.T) {
+	v4, v6 := net.IPv4(127, 0, 0, 1), net.ParseIP("::1")
+	dual := Entry{AddrV4: v4, AddrV6: v6, Port: 8080}
+	v4Only := Entry{AddrV4: v4, Port: 8080}
+	v6Only := Entry{AddrV6: v6, Port: 8080}
+
+	tests := []struct {
+		family AddressFamily
+		entry  Entry
+		want   []string
+	}{
+		{PreferIPv4, dual, []string{"127.0.0.1:8080"}},
+		{PreferIPv4, v6Only, []string{"[::1]:8080"}},
+		{PreferIPv6, dual, []string{"[::1]:8080"}},
+		{PreferIPv6, v4Only, []string{"127.0.0.1:8080"}},
+		{IPv4Only, v6Only, []string{}},
+		{IPv6Only, dual, []string{"[::1]:8080"}},
+		{IPv6Only, v4Only, []string{}},
+		{BothFamilies, dual, []string{"127.0.0.1:8080", "[::1]:8080"}},
+		{BothFamilies, v4Only, []string{"127.0.0.1:8080"}},
+	}
+	for _, test := range tests {
+		have := []string{}
+		for _, ip := range test.family.addresses(test.entry) {
+			have = append(have, hostPort(ip, test.entry.Port))
+		}
+		if !reflect.DeepEqual(test.want, have) {
+			t.Errorf("%d %+v: want: %s have: %s", test.family, test.entry, test.want, have)
+		}
+	}
+}
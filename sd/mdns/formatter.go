@@ -0,0 +1,83 @@
+package mdns
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Formatter formats the instance string of an entry, as published through sd.Event.
+// The address is one of the addresses of the entry, picked by the AddressFamily.
+type Formatter interface {
+	Format(entry Entry, ip net.IP) (string, error)
+}
+
+// FormatterFunc is an adapter to allow the use of ordinary functions as Formatters.
+type FormatterFunc func(entry Entry, ip net.IP) (string, error)
+
+// Format calls f(entry, ip).
+func (f FormatterFunc) Format(entry Entry, ip net.IP) (string, error) {
+	return f(entry, ip)
+}
+
+// IPPortFormatter formats the instances as "ip:port", such as "127.0.0.1:8080" or "[::1]:8080".
+// It is the default formatter.
+var IPPortFormatter Formatter = FormatterFunc(func(entry Entry, ip net.IP) (string, error) {
+	return hostPort(ip, entry.Port), nil
+})
+
+// HostPortFormatter formats the instances as "hostname:port", such as "node1.local:8080".
+// The host names are needed to verify the TLS certificates.
+var HostPortFormatter Formatter = FormatterFunc(func(entry Entry, ip net.IP) (string, error) {
+	return net.JoinHostPort(strings.TrimSuffix(entry.Host, "."), strconv.Itoa(entry.Port)), nil
+})
+
+// URLFormatter returns a formatter which formats the instances as "scheme://ip:port/path",
+// such as "http://127.0.0.1:8080/api".
+func URLFormatter(scheme, path string) Formatter {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return FormatterFunc(func(entry Entry, ip net.IP) (string, error) {
+		return fmt.Sprintf("%s://%s%s", scheme, hostPort(ip, entry.Port), path), nil
+	})
+}
+
+// TemplateFormatter returns a formatter which formats the instances by the text/template.
+// The template is executed with the fields of Entry, and IP, HostName and HostPort:
+//
+//	IP        the address, such as "127.0.0.1"
+//	HostName  the host name without the trailing dot, such as "node1.local"
+//	HostPort  the address with the port, such as "127.0.0.1:8080" or "[::1]:8080"
+//
+// The missing TXT keys are empty, so defaults can be given by "or".
+// For example, taking the scheme and the path from the TXT records:
+//
+//	{{or .Txt.scheme "http"}}://{{.HostPort}}{{.Txt.path}}
+func TemplateFormatter(text string) (Formatter, error) {
+	tmpl, err := template.New("instance").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return FormatterFunc(func(entry Entry, ip net.IP) (string, error) {
+		data := struct {
+			Entry
+			IP       string
+			HostName string
+			HostPort string
+		}{
+			Entry:    entry,
+			IP:       ip.String(),
+			HostName: strings.TrimSuffix(entry.Host, "."),
+			HostPort: hostPort(ip, entry.Port),
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}), nil
+}
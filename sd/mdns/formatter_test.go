@@ -0,0 +1,55 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFormatters(t *testing.T) {
+	entry := Entry{
+		Name: "node1",
+		Host: "node1.local.",
+		Port: 8080,
+		Txt:  map[string]string{"scheme": "https", "path": "/api"},
+	}
+	v4, v6 := net.IPv4(127, 0, 0, 1), net.ParseIP("::1")
+
+	template, err := TemplateFormatter(`{{or .Txt.scheme "http"}}://{{.HostPort}}{{.Txt.path}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostTemplate, err := TemplateFormatter(`{{.Name}}@{{.HostName}}:{{.Port}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		formatter Formatter
+		entry     Entry
+		ip        net.IP
+		want      string
+	}{
+		{IPPortFormatter, entry, v4, "127.0.0.1:8080"},
+		{IPPortFormatter, entry, v6, "[::1]:8080"},
+		{HostPortFormatter, entry, v4, "node1.local:8080"},
+		{URLFormatter("http", "api"), entry, v4, "http://127.0.0.1:8080/api"},
+		{URLFormatter("http", ""), entry, v6, "http://[::1]:8080"},
+		{template, entry, v4, "https://127.0.0.1:8080/api"},
+		{template, Entry{Port: 8080}, v4, "http://127.0.0.1:8080"},
+		{hostTemplate, entry, v4, "node1@node1.local:8080"},
+	}
+	for _, test := range tests {
+		have, err := test.formatter.Format(test.entry, test.ip)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have != test.want {
+			t.Errorf("want: %s have: %s", test.want, have)
+		}
+	}
+
+	if _, err := TemplateFormatter("{{.Port"); err == nil {
+		t.Error("want template error")
+	}
+}
@@ -3,36 +3,101 @@ package mdns
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/sd"
-	"github.com/hashicorp/mdns"
+	"github.com/go-kit/kit/transport"
+	"github.com/miekg/dns"
 
-	"github.com/wencan/kit-plugins/sd/internal/instance"
+	"github.com/wencan/kit-plugins/sd/instance"
 )
 
 const (
-	defaultRefreshInterval = time.Second * 3
+	expiryCheckInterval = time.Second
+
+	defaultRefreshInterval       = time.Second * 3
+	defaultBrowseRefreshInterval = time.Minute
+	defaultLookupTimeout         = time.Second
+	defaultDomain                = "local"
+	defaultBackoffMax            = time.Minute * 5
 )
 
 // InstancerOptions is used to customize how a Lookup is performed.
 type InstancerOptions struct {
-	RefreshInterval     time.Duration  // Refresh intervals, default 3 second
-	Domain              string         // Lookup domain, default "local"
-	LookupTimeout       time.Duration  // Lookup timeout, default 1 second
-	Interface           *net.Interface // Multicast interface to use
-	WantUnicastResponse bool           // Unicast response desired, as per 5.4 in RFC
+	RefreshInterval     time.Duration    // Refresh intervals, default 3 second, or 1 minute in browse mode
+	Domain              string           // Lookup domain, default "local"
+	LookupTimeout       time.Duration    // Lookup timeout, default 1 second
+	Interface           *net.Interface   // Multicast interface to use
+	Interfaces          []*net.Interface // More multicast interfaces to query over, the results are merged
+	AllInterfaces       bool             // Query over all the multicast-capable interfaces
+	AddressFamily       AddressFamily    // Which addresses of the instances are published, default PreferIPv4
+	Formatter           Formatter        // Formats the published instances, default IPPortFormatter
+	Transport           Transport        // Transport of the multicast sockets, default UDPTransport
+	WantUnicastResponse bool             // Unicast response desired, as per 5.4 in RFC
+	Selector            Selector         // Filters entries by TXT attributes, see ParseSelector
+	Browse              bool             // Keep listening for announcements and goodbyes, and refresh only as a safety net
+	Subtype             string           // Looks up only the instances of the subtype, such as "_primary", as per 7.1 in RFC 6763
+	ExpiryGrace         time.Duration    // Keep the instances for the period after their record TTLs run out
+
+	// StaleTimeout keeps serving the last good instances for the period after lookups start failing,
+	// instead of pushing the error to the subscribers. The instances are not expired by their TTLs meanwhile,
+	// but still removed by their goodbyes.
+	StaleTimeout time.Duration
+	// ErrorHandler receives every lookup error, including the ones hidden by StaleTimeout.
+	ErrorHandler transport.ErrorHandler
+
+	// Failing lookups are retried with exponential backoff, until a lookup succeeds.
+	BackoffMin    time.Duration // Delay after the first failure, default RefreshInterval
+	BackoffMax    time.Duration // Maximum delay, default 5 minutes
+	BackoffJitter float64       // Randomization factor of the delays, between 0 and 1
+
+	// Unicast DNS-SD, as per RFC 6763, for the networks blocking multicast.
+	// The instances are resolved from the PTR records to the SRV, TXT, A and AAAA records.
+	// The answers of a lookup are kept until the next lookup, regardless of their TTLs.
+	UnicastServer string      // Address of the DNS server, such as "10.0.0.2:53", disabled if empty
+	UnicastDomain string      // Domain of the services in the DNS server, default Domain
+	UnicastMode   UnicastMode // When to look up over unicast DNS-SD, default UnicastFallback
+
+	Metrics InstancerMetrics // Instruments the instancer
+
+	// SigningKey verifies the signatures of the entries, see RegistrarOptions.SigningKey.
+	// The entries which are unsigned, or signed by other keys, are dropped.
+	SigningKey []byte
+	// MaxSignatureAge drops the entries signed longer ago, default 10 minutes.
+	MaxSignatureAge time.Duration
 }
 
 // Instancer an mDns instancer. It will flushes the cache at intervals.
+// In browse mode, it also applies the announcements and goodbyes as soon as they arrive.
+// The instances are removed when the TTLs of their records run out, or goodbyes arrive.
 type Instancer struct {
-	service string
-	opts    InstancerOptions
+	service     string
+	serviceAddr string // Fully qualified service address
+	queryAddr   string // Fully qualified address looked up, the service or subtype address
+	opts        InstancerOptions
+
+	client *client // nil in UnicastOnly mode
+
+	unicast          *unicastResolver // nil if unicast DNS-SD is disabled
+	unicastQueryAddr string           // Fully qualified address looked up over unicast DNS-SD
 
-	cache *instance.Cache
+	mtx          sync.Mutex
+	table        *serviceTable
+	unicastTable *serviceTable   // Instances of the latest unicast lookup
+	followed     map[string]bool // Names queried for the missing records during this refresh
+	failingSince time.Time       // Time of the first lookup error since the last success
+	published    map[string]bool // Instances of the latest publish
+	invalid      map[string]bool // Names of the entries dropped by the latest publish
+	lastResponse time.Time       // Time of the latest response during this refresh
+
+	cache   *instance.Cache
+	entries *entryCache
 
 	logger log.Logger
 
@@ -43,119 +108,440 @@ type Instancer struct {
 // NewInstancer returns an mDNS instancer.
 func NewInstancer(service string, opts InstancerOptions, logger log.Logger) (*Instancer, error) {
 	if opts.RefreshInterval == 0 {
-		opts.RefreshInterval = defaultRefreshInterval
+		if opts.Browse {
+			opts.RefreshInterval = defaultBrowseRefreshInterval
+		} else {
+			opts.RefreshInterval = defaultRefreshInterval
+		}
+	}
+	if opts.LookupTimeout == 0 {
+		opts.LookupTimeout = defaultLookupTimeout
+	}
+	if opts.Domain == "" {
+		opts.Domain = defaultDomain
+	}
+	if opts.BackoffMin == 0 {
+		opts.BackoffMin = opts.RefreshInterval
+	}
+	if opts.BackoffMax == 0 {
+		opts.BackoffMax = defaultBackoffMax
+	}
+	if opts.MaxSignatureAge == 0 {
+		opts.MaxSignatureAge = defaultMaxSignatureAge
+	}
+	if opts.Formatter == nil {
+		opts.Formatter = IPPortFormatter
+	}
+	if opts.BackoffMax < opts.BackoffMin {
+		opts.BackoffMax = opts.BackoffMin
+	}
+
+	ifaces := append(interfaces(opts.Interface), opts.Interfaces...)
+	if opts.AllInterfaces {
+		var err error
+		ifaces, err = multicastInterfaces()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var client *client
+	if opts.UnicastServer == "" || opts.UnicastMode != UnicastOnly {
+		var err error
+		client, err = newClient(defaultTransport(opts.Transport), ifaces, opts.Browse, false, logger)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
 
+	serviceAddr := serviceAddress(service, opts.Domain)
+	queryAddr := serviceAddr
+	if opts.Subtype != "" {
+		queryAddr = subtypeAddress(opts.Subtype, service, opts.Domain)
+	}
 	inst := &Instancer{
-		service: service,
-		opts:    opts,
-		cache:   instance.NewCache(),
-		logger:  logger,
-		cancel:  cancel,
-		wg:      &wg,
+		service:      service,
+		serviceAddr:  serviceAddr,
+		queryAddr:    queryAddr,
+		opts:         opts,
+		client:       client,
+		table:        newSubtypeTable(serviceAddr, queryAddr),
+		unicastTable: newServiceTable(serviceAddr),
+		followed:     map[string]bool{},
+		published:    map[string]bool{},
+		cache:        instance.NewCache(),
+		entries:      newEntryCache(),
+		logger:       logger,
+		cancel:       cancel,
+		wg:           &wg,
+	}
+
+	if opts.UnicastServer != "" {
+		unicastDomain := opts.UnicastDomain
+		if unicastDomain == "" {
+			unicastDomain = opts.Domain
+		}
+		inst.unicast = &unicastResolver{server: opts.UnicastServer, timeout: opts.LookupTimeout}
+		inst.unicastQueryAddr = serviceAddress(service, unicastDomain)
+		if opts.Subtype != "" {
+			inst.unicastQueryAddr = subtypeAddress(opts.Subtype, service, unicastDomain)
+		}
+		inst.unicastTable = newSubtypeTable(serviceAddress(service, unicastDomain), inst.unicastQueryAddr)
 	}
+	inst.table.received = opts.Metrics.EntriesReceived
+
+	wg.Add(1)
+	go inst.receive(ctx)
 
 	// first lookup
-	inst.refresh(ctx)
+	err := inst.refresh(ctx)
 
-	go inst.loop(ctx)
+	wg.Add(1)
+	go inst.loop(ctx, err)
 
 	return inst, nil
 }
 
-func (inst *Instancer) loop(ctx context.Context) {
-	inst.wg.Add(1)
+// loop refreshes one at a time, at the refresh interval,
+// or backs off after the lookup failed.
+func (inst *Instancer) loop(ctx context.Context, err error) {
 	defer inst.wg.Done()
 
-	refreshTicker := time.NewTicker(inst.opts.RefreshInterval)
-	defer refreshTicker.Stop()
+	failures := 0
+	for {
+		delay := inst.opts.RefreshInterval
+		if err != nil {
+			failures++
+			delay = inst.backoff(failures)
+		} else {
+			failures = 0
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			err = inst.refresh(ctx)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// backoff returns the delay after the failures.
+func (inst *Instancer) backoff(failures int) time.Duration {
+	delay := inst.opts.BackoffMin
+	for i := 1; i < failures && delay < inst.opts.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > inst.opts.BackoffMax {
+		delay = inst.opts.BackoffMax
+	}
+
+	if jitter := inst.opts.BackoffJitter; jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		delta := float64(delay) * jitter
+		delay = time.Duration(float64(delay) - delta + rand.Float64()*2*delta)
+	}
+	return delay
+}
+
+// receive applies the received responses and announcements, and expires the stale records.
+func (inst *Instancer) receive(ctx context.Context) {
+	defer inst.wg.Done()
+
+	expiryTicker := time.NewTicker(expiryCheckInterval)
+	defer expiryTicker.Stop()
+
+	var messages <-chan *dns.Msg // never receives in UnicastOnly mode
+	if inst.client != nil {
+		messages = inst.client.messages()
+	}
 
 	for {
 		select {
-		case <-refreshTicker.C:
-			inst.wg.Add(1)
-			go func() {
-				defer inst.wg.Done()
-				inst.refresh(ctx)
-			}()
+		case now := <-expiryTicker.C:
+			inst.mtx.Lock()
+			// the unicast table is a snapshot, replaced by the next lookup,
+			// and the last good instances are kept while the lookups are failing within the stale timeout
+			if !inst.stale(now) && inst.table.expire(now, inst.opts.ExpiryGrace) {
+				inst.publish()
+			}
+			inst.mtx.Unlock()
+		case msg := <-messages:
+			now := time.Now()
+			inst.mtx.Lock()
+			if inst.table.apply(msg, now) {
+				inst.publish()
+			}
+			if inst.table.matches(msg) {
+				inst.lastResponse = now
+			}
+			questions := inst.followups()
+			inst.mtx.Unlock()
+
+			if len(questions) > 0 {
+				if err := inst.client.query(questions...); err != nil {
+					inst.logger.Log("action", "query", "err", err)
+				}
+			}
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (inst *Instancer) refresh(ctx context.Context) {
-	instances, err := inst.lookup(ctx)
+func (inst *Instancer) refresh(ctx context.Context) error {
+	duration, err := inst.lookup(ctx)
+	if ctx.Err() != nil {
+		return nil // stopped
+	}
+	observeHistogram(inst.opts.Metrics.LookupDuration, duration.Seconds())
 	if err != nil {
+		addCounter(inst.opts.Metrics.LookupErrors, 1)
+		// not holding the lock, a slow handler does not stall the receiver
+		if inst.opts.ErrorHandler != nil {
+			inst.opts.ErrorHandler.Handle(ctx, err)
+		}
+	}
+
+	inst.mtx.Lock()
+	defer inst.mtx.Unlock()
+
+	if err != nil {
+		now := time.Now()
+		if inst.failingSince.IsZero() {
+			inst.failingSince = now
+		}
+		if inst.stale(now) {
+			return err // keep serving the last good instances
+		}
+
+		inst.entries.update(EntryEvent{Err: err})
 		inst.cache.Update(sd.Event{Err: err})
-	} else {
-		inst.cache.Update(sd.Event{Instances: instances})
+		inst.measure(nil)
+		return err
+	}
+
+	inst.failingSince = time.Time{}
+	inst.publish()
+	return nil
+}
+
+// stale reports whether the lookups are failing within the stale timeout.
+// The caller must hold inst.mtx.
+func (inst *Instancer) stale(now time.Time) bool {
+	return !inst.failingSince.IsZero() && now.Sub(inst.failingSince) < inst.opts.StaleTimeout
+}
+
+// lookup looks up a given service over multicast, and over unicast DNS-SD if enabled,
+// as a fallback when multicast finds no instances or fails, or as the only mode.
+// It returns the time the lookups take.
+func (inst *Instancer) lookup(ctx context.Context) (time.Duration, error) {
+	var duration time.Duration
+	var err error
+	if inst.client != nil {
+		duration, err = inst.multicastLookup(ctx)
+		if ctx.Err() != nil {
+			return duration, ctx.Err()
+		}
 	}
+	if inst.unicast == nil {
+		return duration, err
+	}
+
+	if inst.opts.UnicastMode == UnicastFallback && err == nil {
+		inst.mtx.Lock()
+		found := len(inst.table.serviceEntries()) > 0
+		inst.mtx.Unlock()
+		if found {
+			return duration, nil
+		}
+	}
+	begin := time.Now()
+	err = inst.unicastLookup(ctx)
+	return duration + time.Since(begin), err
 }
 
-// lookup looks up a given service, in a domain, waiting at most
+// unicastLookup looks up a given service over unicast DNS-SD.
+// The instances of the previous lookup are replaced.
+func (inst *Instancer) unicastLookup(ctx context.Context) error {
+	records, err := inst.unicast.lookup(ctx, inst.unicastQueryAddr)
+	if err != nil {
+		inst.logger.Log("action", "unicast", "err", err)
+		return err
+	}
+
+	table := newSubtypeTable(inst.unicastTable.serviceAddr, inst.unicastQueryAddr)
+	table.snapshot = true
+	table.apply(&dns.Msg{Answer: records}, time.Now())
+
+	inst.mtx.Lock()
+	defer inst.mtx.Unlock()
+	received := countChanged(inst.unicastTable.serviceEntries(), table.serviceEntries())
+	addCounter(inst.opts.Metrics.EntriesReceived, float64(received))
+	inst.unicastTable = table
+	return nil
+}
+
+// multicastLookup looks up a given service, in a domain, waiting at most
 // for a timeout before finishing the query.
-func (inst *Instancer) lookup(ctx context.Context) ([]string, error) {
-	entriesChan := make(chan *mdns.ServiceEntry, 100)
-	instances := make([]string, 0)
+// It returns the time from the query to the last response, or the timeout if nothing responds.
+func (inst *Instancer) multicastLookup(ctx context.Context) (time.Duration, error) {
+	inst.mtx.Lock()
+	inst.followed = map[string]bool{}
+	inst.lastResponse = time.Time{}
+	inst.mtx.Unlock()
 
-	var lookupWG sync.WaitGroup
-	lookupWG.Add(1)
-	go func() {
-		defer lookupWG.Done()
+	begin := time.Now()
+	question := newQuestion(inst.queryAddr, dns.TypePTR, inst.opts.WantUnicastResponse)
+	if err := inst.client.query(question); err != nil {
+		inst.logger.Log("action", "query", "err", err)
+		return time.Since(begin), err
+	}
 
-		for {
-			select {
-			case entry, ok := <-entriesChan:
-				if !ok {
-					return
-				}
-				instance, err := getInstance(entry)
-				if err != nil {
-					inst.logger.Log("action", "lookup", "err", err)
-				} else {
-					instances = append(instances, instance)
-				}
-			case <-ctx.Done():
-				return
+	// The responses are applied by the receiver until the timeout
+	timer := time.NewTimer(inst.opts.LookupTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return time.Since(begin), ctx.Err()
+	}
+
+	inst.mtx.Lock()
+	lastResponse := inst.lastResponse
+	inst.mtx.Unlock()
+	if lastResponse.IsZero() {
+		return inst.opts.LookupTimeout, nil
+	}
+	return lastResponse.Sub(begin), nil
+}
+
+// followups returns the questions for the missing records, which are not queried during this refresh.
+// The caller must hold inst.mtx.
+func (inst *Instancer) followups() []dns.Question {
+	var questions []dns.Question
+	for _, question := range inst.table.incomplete() {
+		key := fmt.Sprintf("%s/%d", question.Name, question.Qtype)
+		if !inst.followed[key] {
+			inst.followed[key] = true
+			questions = append(questions, question)
+		}
+	}
+	return questions
+}
+
+// publish pushes the entries of the table to the caches,
+// the unicast DNS-SD entries if multicast finds no instances, or in UnicastOnly mode.
+// The caller must hold inst.mtx.
+func (inst *Instancer) publish() {
+	entries := make([]Entry, 0)
+	instances := make([]string, 0)
+	seen := map[string]bool{}
+	table := inst.table
+	if inst.unicast != nil && (inst.opts.UnicastMode == UnicastOnly || len(table.serviceEntries()) == 0) {
+		table = inst.unicastTable
+	}
+	invalid := map[string]bool{}
+	for _, serviceEntry := range table.serviceEntries() {
+		entry := newEntry(serviceEntry, table.serviceAddr)
+		addrs := inst.format(entry)
+		if len(addrs) == 0 {
+			if !inst.invalid[serviceEntry.Name] {
+				addCounter(inst.opts.Metrics.InvalidEntries, 1)
+			}
+			invalid[serviceEntry.Name] = true
+			continue
+		}
+		if !inst.verified(entry) || !inst.selected(entry) {
+			continue
+		}
+		entry.Instance = addrs[0]
+		entries = append(entries, entry)
+		for _, addr := range addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				instances = append(instances, addr)
 			}
 		}
-	}()
+	}
+	inst.invalid = invalid
+	inst.entries.update(EntryEvent{Entries: entries})
+	inst.cache.Update(sd.Event{Instances: instances})
+	inst.measure(instances)
+}
 
-	param := &mdns.QueryParam{
-		Service:             inst.service,
-		Domain:              inst.opts.Domain,
-		Timeout:             inst.opts.LookupTimeout,
-		Interface:           inst.opts.Interface,
-		Entries:             entriesChan,
-		WantUnicastResponse: inst.opts.WantUnicastResponse,
+// measure reports the published instances, and the changes since the previous publish.
+// The caller must hold inst.mtx.
+func (inst *Instancer) measure(instances []string) {
+	published := make(map[string]bool, len(instances))
+	added := 0
+	for _, instance := range instances {
+		published[instance] = true
+		if !inst.published[instance] {
+			added++
+		}
 	}
-	err := mdns.Query(param)
-	close(entriesChan)
-	lookupWG.Wait()
+	removed := len(inst.published) - (len(instances) - added)
+	inst.published = published
 
-	if err != nil {
-		inst.logger.Log("action", "query", "err", err)
-		return nil, err
+	setGauge(inst.opts.Metrics.Instances, float64(len(instances)))
+	addCounter(inst.opts.Metrics.InstancesAdded, float64(added))
+	addCounter(inst.opts.Metrics.InstancesRemoved, float64(removed))
+}
+
+// format returns the instances of the entry, the first is preferred.
+func (inst *Instancer) format(entry Entry) []string {
+	var instances []string
+	for _, ip := range inst.opts.AddressFamily.addresses(entry) {
+		instance, err := inst.opts.Formatter.Format(entry, ip)
+		if err != nil {
+			inst.logger.Log("action", "format", "instance", entry.Name, "err", err)
+			continue
+		}
+		instances = append(instances, instance)
 	}
-	return instances, nil
+	return instances
+}
+
+// serviceAddress returns the fully qualified service address.
+func serviceAddress(service, domain string) string {
+	return fmt.Sprintf("%s.%s.", strings.Trim(service, "."), strings.Trim(domain, "."))
 }
 
-// getInstance get the instance address from mdns.ServiceEntry.
-func getInstance(entry *mdns.ServiceEntry) (string, error) {
-	if entry.AddrV4 != nil {
-		instance := fmt.Sprintf("%s:%d", entry.AddrV4.String(), entry.Port)
-		return instance, nil
-	} else if entry.AddrV6 != nil {
-		instance := fmt.Sprintf("%s:%d", entry.AddrV6.String(), entry.Port)
-		return instance, nil
-	} else {
-		err := fmt.Errorf("invalid mdns entry: %v", entry)
-		return "", err
+// verified reports whether the signature of the entry is verified, if the signing key is set.
+// The dropped entries are logged at debug level.
+func (inst *Instancer) verified(entry Entry) bool {
+	if len(inst.opts.SigningKey) == 0 {
+		return true
 	}
+	err := verifyEntry(inst.opts.SigningKey, inst.service, entry, time.Now(), inst.opts.MaxSignatureAge)
+	if err == nil {
+		return true
+	}
+	level.Debug(inst.logger).Log("action", "verify", "instance", entry.Instance, "name", entry.Name, "err", err)
+	return false
+}
+
+// selected reports whether the entry is accepted by the selector.
+// The excluded entries are logged at debug level.
+func (inst *Instancer) selected(entry Entry) bool {
+	if inst.opts.Selector == nil || inst.opts.Selector.Matches(entry) {
+		return true
+	}
+
+	keyvals := []interface{}{"action", "select", "instance", entry.Instance, "name", entry.Name, "txt", fmt.Sprint(entry.Txt)}
+	if selector, ok := inst.opts.Selector.(labelSelector); ok {
+		r, _ := selector.unmatched(entry)
+		keyvals = append(keyvals, "unmatched", r.String())
+	}
+	level.Debug(inst.logger).Log(keyvals...)
+	return false
 }
 
 // Register implements Instancer.
@@ -173,9 +559,29 @@ func (inst *Instancer) State() sd.Event {
 	return inst.cache.State()
 }
 
+// RegisterEntries registers a channel to receive the discovered entries with their metadata.
+// The current state is pushed to the channel immediately.
+func (inst *Instancer) RegisterEntries(ch chan<- EntryEvent) {
+	inst.entries.register(ch)
+}
+
+// DeregisterEntries deregisters a channel registered by RegisterEntries.
+func (inst *Instancer) DeregisterEntries(ch chan<- EntryEvent) {
+	inst.entries.deregister(ch)
+}
+
+// EntryState returns the current state of discovery (entries or error) as EntryEvent.
+func (inst *Instancer) EntryState() EntryEvent {
+	return inst.entries.current()
+}
+
 // Stop terminates the Instancer.
 func (inst *Instancer) Stop() {
 	inst.cancel()
-	inst.cache.Stop()
 	inst.wg.Wait()
+	inst.cache.Stop()
+	inst.entries.stop()
+	if inst.client != nil {
+		inst.client.Close()
+	}
 }
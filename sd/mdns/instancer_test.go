@@ -1,6 +1,7 @@
 package mdns
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
@@ -10,7 +11,13 @@ import (
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/transport"
 	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+
+	"github.com/wencan/kit-plugins/sd/mdns/mdnstest"
 )
 
 func newTestServer(serviceName string, port int) (*mdns.Server, string, error) {
@@ -72,3 +79,565 @@ func TestMDNSInstancer(t *testing.T) {
 		t.Errorf("want: %s have: %s", want, have)
 	}
 }
+
+func TestMDNSInstancerEntries(t *testing.T) {
+	serviceName := "test.entries.mdns.kit"
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+	port := rand.Intn(1000) + 1
+	instance := fmt.Sprintf("%s:%d", ips[0].String(), port)
+	txt := []string{"version=v2", "zone=a", "canary"}
+	service, err := mdns.NewMDNSService("node1", serviceName, "", "test.host.", port, ips, txt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := mdns.NewServer(&mdns.Config{Zone: service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	// Create the mDNS instancer
+	instancer, err := NewInstancer(serviceName, InstancerOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	entriesCh := make(chan EntryEvent, 1)
+	instancer.RegisterEntries(entriesCh)
+	defer instancer.DeregisterEntries(entriesCh)
+
+	event := <-entriesCh
+	if event.Err != nil {
+		t.Fatal(event.Err)
+	}
+	if want, have := 1, len(event.Entries); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+	have := event.Entries[0]
+	want := Entry{
+		Instance: instance,
+		Name:     "node1",
+		Host:     "test.host.",
+		AddrV4:   have.AddrV4,
+		Port:     port,
+		Txt:      map[string]string{"version": "v2", "zone": "a", "canary": ""},
+	}
+	if !have.AddrV4.Equal(ips[0]) {
+		t.Errorf("want address: %s, have: %s", ips[0], have.AddrV4)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %+v have: %+v", want, have)
+	}
+
+	// The plain instances are kept in sync
+	if want, have := []string{instance}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
+
+func TestMDNSInstancerSelector(t *testing.T) {
+	serviceName := "test.selector.mdns.kit"
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+	want := []string{}
+	port := 0
+	for _, env := range []string{"prod", "staging", "prod", "dev"} {
+		port += rand.Intn(1000) + 1
+		instance := fmt.Sprintf("%s:%d", ips[0].String(), port)
+		service, err := mdns.NewMDNSService(instance, serviceName, "", "", port, ips, []string{"env=" + env})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := mdns.NewServer(&mdns.Config{Zone: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Shutdown()
+
+		if env == "prod" {
+			want = append(want, instance)
+		}
+	}
+
+	selector, err := ParseSelector("env=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		Selector: selector,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	event := instancer.State()
+	if event.Err != nil {
+		t.Fatal(event.Err)
+	}
+	have := event.Instances
+
+	sort.Strings(want)
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
+
+// announce multicasts the records as an unsolicited response.
+func announce(records []dns.RR) error {
+	msg := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response:      true,
+			Authoritative: true,
+		},
+		Answer: records,
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.WriteTo(buf, ipv4Group)
+	return err
+}
+
+func expectInstances(t *testing.T, ch chan sd.Event, want []string) {
+	t.Helper()
+
+	select {
+	case event := <-ch:
+		if event.Err != nil {
+			t.Fatal(event.Err)
+		}
+		have := event.Instances
+		if len(want) == 0 && len(have) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Fatalf("want: %s have: %s", want, have)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("did not receive expected instances %s", want)
+	}
+}
+
+func TestMDNSInstancerBrowse(t *testing.T) {
+	serviceName := "test.browse.mdns.kit"
+
+	// Create the mDNS instancer, which never refreshes during the test
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		Browse:          true,
+		RefreshInterval: time.Hour,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	eventsCh := make(chan sd.Event, 10)
+	instancer.Register(eventsCh)
+	defer instancer.Deregister(eventsCh)
+	expectInstances(t, eventsCh, nil)
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+	port := rand.Intn(1000) + 1
+	instance := fmt.Sprintf("%s:%d", ips[0].String(), port)
+	service, err := mdns.NewMDNSService("node1", serviceName, "", "test.host.", port, ips, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := service.Records(dns.Question{Name: serviceName + ".local.", Qtype: dns.TypePTR})
+
+	// Unsolicited announcement
+	if err := announce(records); err != nil {
+		t.Fatal(err)
+	}
+	expectInstances(t, eventsCh, []string{instance})
+
+	// Goodbye
+	for _, rr := range records {
+		rr.Header().Ttl = 0
+	}
+	if err := announce(records); err != nil {
+		t.Fatal(err)
+	}
+	expectInstances(t, eventsCh, nil)
+}
+
+func TestMDNSInstancerExpiry(t *testing.T) {
+	serviceName := "test.expiry.mdns.kit"
+
+	// Create the mDNS instancer, which never refreshes during the test
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		Browse:          true,
+		RefreshInterval: time.Hour,
+		ExpiryGrace:     time.Second,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	eventsCh := make(chan sd.Event, 10)
+	instancer.Register(eventsCh)
+	defer instancer.Deregister(eventsCh)
+	expectInstances(t, eventsCh, nil)
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+	port := rand.Intn(1000) + 1
+	instance := fmt.Sprintf("%s:%d", ips[0].String(), port)
+	service, err := mdns.NewMDNSService("node1", serviceName, "", "test.host.", port, ips, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := service.Records(dns.Question{Name: serviceName + ".local.", Qtype: dns.TypePTR})
+	for _, rr := range records {
+		rr.Header().Ttl = 1
+	}
+
+	announced := time.Now()
+	if err := announce(records); err != nil {
+		t.Fatal(err)
+	}
+	expectInstances(t, eventsCh, []string{instance})
+
+	// Removed after the TTL and the grace period run out
+	select {
+	case event := <-eventsCh:
+		if want, have := 0, len(event.Instances); want != have {
+			t.Fatalf("want %d instances, have %d", want, have)
+		}
+		if elapsed := time.Since(announced); elapsed < time.Second*2 {
+			t.Errorf("removed too early: %s", elapsed)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("instance did not expire")
+	}
+}
+
+func TestMDNSInstancerStaleOnError(t *testing.T) {
+	serviceName := "test.stale.mdns.kit"
+
+	var errs []error
+	errorHandler := transport.ErrorHandlerFunc(func(ctx context.Context, err error) {
+		errs = append(errs, err)
+	})
+
+	// Create the mDNS instancer, which never refreshes during the test
+	staleTimeout := time.Second * 3
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		Browse:          true,
+		RefreshInterval: time.Hour,
+		StaleTimeout:    staleTimeout,
+		ErrorHandler:    errorHandler,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	eventsCh := make(chan sd.Event, 10)
+	instancer.Register(eventsCh)
+	defer instancer.Deregister(eventsCh)
+	expectInstances(t, eventsCh, nil)
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+	port := rand.Intn(1000) + 1
+	instance := fmt.Sprintf("%s:%d", ips[0].String(), port)
+	service, err := mdns.NewMDNSService("node1", serviceName, "", "test.host.", port, ips, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := service.Records(dns.Question{Name: serviceName + ".local.", Qtype: dns.TypePTR})
+	for _, rr := range records {
+		rr.Header().Ttl = 1
+	}
+	if err := announce(records); err != nil {
+		t.Fatal(err)
+	}
+	expectInstances(t, eventsCh, []string{instance})
+
+	// Break the query sockets
+	for _, conn := range instancer.client.conns {
+		if !conn.multicast {
+			conn.Close()
+		}
+	}
+
+	// The last good instances are kept
+	instancer.refresh(context.Background())
+	failing := time.Now() // not before the first error
+	if want, have := []string{instance}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+	if want, have := 1, len(errs); want != have {
+		t.Fatalf("want %d errors, have %d", want, have)
+	}
+
+	// Not expired by the TTLs while failing
+	time.Sleep(expiryCheckInterval * 2)
+	if want, have := []string{instance}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	// Until the stale timeout runs out
+	time.Sleep(staleTimeout - time.Since(failing))
+	instancer.refresh(context.Background())
+	if instancer.State().Err == nil {
+		t.Error("want error")
+	}
+	if want, have := 2, len(errs); want != have {
+		t.Fatalf("want %d errors, have %d", want, have)
+	}
+}
+
+func TestInstancerBackoff(t *testing.T) {
+	inst := &Instancer{opts: InstancerOptions{
+		BackoffMin: time.Second,
+		BackoffMax: time.Second * 10,
+	}}
+	for _, testcase := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, time.Second * 2},
+		{3, time.Second * 4},
+		{4, time.Second * 8},
+		{5, time.Second * 10},
+		{100, time.Second * 10},
+	} {
+		if have := inst.backoff(testcase.failures); testcase.want != have {
+			t.Errorf("failures: %d want: %s have: %s", testcase.failures, testcase.want, have)
+		}
+	}
+
+	// The jitter randomizes the delay around the backoff
+	inst.opts.BackoffJitter = 0.5
+	for i := 0; i < 100; i++ {
+		if have := inst.backoff(2); have < time.Second || have > time.Second*3 {
+			t.Fatalf("delay out of range: %s", have)
+		}
+	}
+}
+
+func TestMDNSInstancerSubtype(t *testing.T) {
+	serviceName := "test.subtype.mdns.kit"
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+
+	responder, err := NewResponder(nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+
+	for i, subtype := range []string{"_primary", "_canary"} {
+		registrar, err := NewRegistrarWithOptions(Service{
+			Instance: fmt.Sprintf("node%d", i+1),
+			Service:  serviceName,
+			HostName: fmt.Sprintf("host%d.", i+1),
+			Port:     8081 + i,
+			Ips:      ips,
+			Subtypes: []string{subtype},
+		}, RegistrarOptions{Responder: responder}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		registrar.Register()
+		defer registrar.Deregister()
+	}
+
+	// Only the instances of the subtype are looked up
+	instancer, err := NewInstancer(serviceName, InstancerOptions{Subtype: "_canary"}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+	if want, have := []string{"127.0.0.1:8082"}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	// And all the instances of the service without the subtype
+	entries, err := LookupEntries(context.Background(), serviceName, LookupOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(entries); want != have {
+		t.Errorf("want %d entries, have %d", want, have)
+	}
+}
+
+func TestMDNSInstancerDualStack(t *testing.T) {
+	serviceName := "test.dualstack.mdns.kit"
+
+	registrar, err := NewRegistrar(Service{
+		Instance: "node1",
+		Service:  serviceName,
+		Port:     8081,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1), net.ParseIP("::1")}, // Just for test
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar.Register()
+	defer registrar.Deregister()
+
+	// Both addresses are published, the results over the interfaces are merged
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		AllInterfaces: true,
+		AddressFamily: BothFamilies,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+	if want, have := []string{"127.0.0.1:8081", "[::1]:8081"}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+	if want, have := "127.0.0.1:8081", instancer.EntryState().Entries[0].Instance; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
+
+func TestMDNSInstancerMetrics(t *testing.T) {
+	serviceName := "test.metrics.mdns.kit"
+
+	queriesAnswered := generic.NewCounter("queries_answered")
+	registrar, err := NewRegistrarWithOptions(Service{
+		Instance: "node1",
+		Service:  serviceName,
+		Port:     8081,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)}, // Just for test
+	}, RegistrarOptions{
+		Metrics: RegistrarMetrics{QueriesAnswered: queriesAnswered},
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar.Register()
+	defer registrar.Deregister()
+
+	metrics := InstancerMetrics{
+		LookupDuration:   generic.NewHistogram("lookup_duration_seconds", 10),
+		LookupErrors:     generic.NewCounter("lookup_errors"),
+		EntriesReceived:  generic.NewCounter("entries_received"),
+		InvalidEntries:   generic.NewCounter("invalid_entries"),
+		Instances:        generic.NewGauge("instances"),
+		InstancesAdded:   generic.NewCounter("instances_added"),
+		InstancesRemoved: generic.NewCounter("instances_removed"),
+	}
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		AddressFamily: IPv6Only, // the entry without IPv6 address is invalid
+		Metrics:       metrics,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	if have := queriesAnswered.Value(); have == 0 {
+		t.Error("want queries answered")
+	}
+	if have := metrics.LookupDuration.(*generic.Histogram).Quantile(0.5); have <= 0 || have >= 1 {
+		t.Errorf("want lookup duration less than the timeout, have: %f", have)
+	}
+	for _, test := range []struct {
+		name string
+		want float64
+		have float64
+	}{
+		{"lookup errors", 0, metrics.LookupErrors.(*generic.Counter).Value()},
+		{"entries received", 1, metrics.EntriesReceived.(*generic.Counter).Value()},
+		{"invalid entries", 1, metrics.InvalidEntries.(*generic.Counter).Value()},
+		{"instances", 0, metrics.Instances.(*generic.Gauge).Value()},
+		{"instances added", 0, metrics.InstancesAdded.(*generic.Counter).Value()},
+	} {
+		if test.want != test.have {
+			t.Errorf("%s: want: %f have: %f", test.name, test.want, test.have)
+		}
+	}
+}
+
+func TestInstancerMeasure(t *testing.T) {
+	metrics := InstancerMetrics{
+		Instances:        generic.NewGauge("instances"),
+		InstancesAdded:   generic.NewCounter("instances_added"),
+		InstancesRemoved: generic.NewCounter("instances_removed"),
+	}
+	inst := &Instancer{opts: InstancerOptions{Metrics: metrics}, published: map[string]bool{}}
+
+	for _, test := range []struct {
+		instances             []string
+		count, added, removed float64
+	}{
+		{[]string{"a", "b"}, 2, 2, 0},
+		{[]string{"b", "c", "d"}, 3, 4, 1},
+		{nil, 0, 4, 4},
+	} {
+		inst.measure(test.instances)
+		if want, have := test.count, metrics.Instances.(*generic.Gauge).Value(); want != have {
+			t.Errorf("%s: want %f instances, have %f", test.instances, want, have)
+		}
+		if want, have := test.added, metrics.InstancesAdded.(*generic.Counter).Value(); want != have {
+			t.Errorf("%s: want %f added, have %f", test.instances, want, have)
+		}
+		if want, have := test.removed, metrics.InstancesRemoved.(*generic.Counter).Value(); want != have {
+			t.Errorf("%s: want %f removed, have %f", test.instances, want, have)
+		}
+	}
+}
+
+func TestMDNSInstancerSigned(t *testing.T) {
+	serviceName := "test.signed.mdns.kit"
+	key := []byte("secret")
+	network := mdnstest.NewNetwork(1)
+
+	for i, key := range [][]byte{key, nil, []byte("other")} {
+		registrar, err := NewRegistrarWithOptions(Service{
+			Instance: fmt.Sprintf("node%d", i+1),
+			Service:  serviceName,
+			HostName: fmt.Sprintf("host%d.", i+1),
+			Port:     8081 + i,
+			Ips:      []net.IP{net.IPv4(127, 0, 0, 1)}, // Just for test
+		}, RegistrarOptions{Transport: network, SigningKey: key}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		registrar.Register()
+		defer registrar.Deregister()
+	}
+
+	// The names with spaces are escaped on the wire
+	registrar, err := NewRegistrarWithOptions(Service{
+		Instance: "web node",
+		Service:  serviceName,
+		HostName: "host4.",
+		Port:     8084,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)}, // Just for test
+	}, RegistrarOptions{Transport: network, SigningKey: key}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar.Register()
+	defer registrar.Deregister()
+
+	// Only the instances signed by the key are published
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		Transport:  network,
+		SigningKey: key,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+	if want, have := []string{"127.0.0.1:8081", "127.0.0.1:8084"}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
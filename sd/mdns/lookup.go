@@ -0,0 +1,162 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/miekg/dns"
+)
+
+// servicesEnumeration is the name of the service type enumeration, as per 9 in RFC 6763.
+const servicesEnumeration = "_services._dns-sd._udp"
+
+// LookupOptions is used to customize a one-shot lookup.
+type LookupOptions struct {
+	Domain              string         // Lookup domain, default "local"
+	Timeout             time.Duration  // Lookup timeout, default 1 second
+	Interface           *net.Interface // Multicast interface to use
+	Transport           Transport      // Transport of the multicast sockets, default UDPTransport
+	WantUnicastResponse bool           // Unicast response desired, as per 5.4 in RFC
+	Subtype             string         // Lists only the instances of the subtype, by LookupEntries
+}
+
+func (opts *LookupOptions) setDefaults() {
+	if opts.Domain == "" {
+		opts.Domain = defaultDomain
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultLookupTimeout
+	}
+}
+
+// LookupServices lists the service types advertised in the domain, by the DNS-SD service type enumeration.
+// The services are returned without the domain, sorted, such as "_http._tcp".
+// It waits for the responses until the timeout, or ctx is done.
+func LookupServices(ctx context.Context, opts LookupOptions, logger log.Logger) ([]string, error) {
+	opts.setDefaults()
+
+	c, err := newClient(defaultTransport(opts.Transport), interfaces(opts.Interface), false, false, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	enumAddr := serviceAddress(servicesEnumeration, opts.Domain)
+	domain := "." + strings.Trim(opts.Domain, ".") + "."
+	if err := c.query(newQuestion(enumAddr, dns.TypePTR, opts.WantUnicastResponse)); err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	err = receiveUntil(ctx, c, opts.Timeout, func(msg *dns.Msg) {
+		for _, rr := range msg.Answer {
+			ptr, ok := rr.(*dns.PTR)
+			if !ok || !strings.EqualFold(ptr.Hdr.Name, enumAddr) || ptr.Hdr.Ttl == 0 {
+				continue
+			}
+			if n := len(ptr.Ptr) - len(domain); n > 0 && strings.EqualFold(ptr.Ptr[n:], domain) {
+				found[ptr.Ptr[:n]] = true
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]string, 0, len(found))
+	for service := range found {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// LookupEntries lists the instances of the service, with their metadata, sorted by name.
+// It waits for the responses until the timeout, or ctx is done.
+func LookupEntries(ctx context.Context, service string, opts LookupOptions, logger log.Logger) ([]Entry, error) {
+	opts.setDefaults()
+
+	c, err := newClient(defaultTransport(opts.Transport), interfaces(opts.Interface), false, false, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	serviceAddr := serviceAddress(service, opts.Domain)
+	queryAddr := serviceAddr
+	if opts.Subtype != "" {
+		queryAddr = subtypeAddress(opts.Subtype, service, opts.Domain)
+	}
+	if err := c.query(newQuestion(queryAddr, dns.TypePTR, opts.WantUnicastResponse)); err != nil {
+		return nil, err
+	}
+
+	table := newSubtypeTable(serviceAddr, queryAddr)
+	followed := map[string]bool{}
+	err = receiveUntil(ctx, c, opts.Timeout, func(msg *dns.Msg) {
+		table.apply(msg, time.Now())
+
+		var questions []dns.Question
+		for _, question := range table.incomplete() {
+			key := fmt.Sprintf("%s/%d", question.Name, question.Qtype)
+			if !followed[key] {
+				followed[key] = true
+				questions = append(questions, question)
+			}
+		}
+		if len(questions) > 0 {
+			if err := c.query(questions...); err != nil {
+				logger.Log("action", "query", "err", err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0)
+	for _, serviceEntry := range table.serviceEntries() {
+		entry := newEntry(serviceEntry, serviceAddr)
+		// the complete entries have an address at least
+		entry.Instance = hostPort(PreferIPv4.addresses(entry)[0], entry.Port)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// newQuestion returns a question of the name.
+// In the Question Section of a Multicast DNS query, the top bit of the qclass
+// field is used to indicate that unicast responses are preferred for this
+// particular question. (See Section 5.4 in RFC 6762.)
+func newQuestion(name string, qtype uint16, unicastResponse bool) dns.Question {
+	question := dns.Question{
+		Name:   name,
+		Qtype:  qtype,
+		Qclass: dns.ClassINET,
+	}
+	if unicastResponse {
+		question.Qclass |= unicastResponseBit
+	}
+	return question
+}
+
+// receiveUntil handles the received messages until the timeout, or ctx is done.
+func receiveUntil(ctx context.Context, c *client, timeout time.Duration, handle func(msg *dns.Msg)) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-c.messages():
+			handle(msg)
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
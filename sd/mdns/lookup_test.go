@@ -0,0 +1,82 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestLookup(t *testing.T) {
+	serviceNames := []string{"_http._tcp", "_metrics._tcp"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+
+	responder, err := NewResponder(nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+
+	for i, serviceName := range serviceNames {
+		registrar, err := NewRegistrarWithOptions(Service{
+			Instance: "lookup",
+			Service:  serviceName,
+			HostName: "test.host.",
+			Port:     8081 + i,
+			Ips:      ips,
+			Txt:      []string{"version=1"},
+		}, RegistrarOptions{Responder: responder}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		registrar.Register()
+		defer registrar.Deregister()
+	}
+
+	// Lists the service types
+	services, err := LookupServices(context.Background(), LookupOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serviceName := range serviceNames {
+		found := false
+		for _, service := range services {
+			found = found || service == serviceName
+		}
+		if !found {
+			t.Errorf("want: %s have: %s", serviceName, services)
+		}
+	}
+
+	// And the instances of the type
+	entries, err := LookupEntries(context.Background(), serviceNames[1], LookupOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(entries); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+	want := Entry{
+		Instance: "127.0.0.1:8082",
+		Name:     "lookup",
+		Host:     "test.host.",
+		AddrV4:   entries[0].AddrV4,
+		Port:     8082,
+		Txt:      map[string]string{"version": "1"},
+	}
+	if !reflect.DeepEqual(want, entries[0]) {
+		t.Errorf("want: %+v have: %+v", want, entries[0])
+	}
+
+	// Gives up when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if want, have := context.Canceled, func() error {
+		_, err := LookupServices(ctx, LookupOptions{}, log.NewNopLogger())
+		return err
+	}(); want != have {
+		t.Errorf("want: %v have: %v", want, have)
+	}
+}
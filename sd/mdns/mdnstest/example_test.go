@@ -0,0 +1,46 @@
+package mdnstest_test
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/wencan/kit-plugins/sd/mdns"
+	"github.com/wencan/kit-plugins/sd/mdns/mdnstest"
+)
+
+func Example() {
+	logger := log.NewNopLogger()
+
+	// The network delivers every packet twice, after 10 milliseconds
+	network := mdnstest.NewNetwork(1)
+	network.SetConditions(mdnstest.Conditions{Duplicate: 1, Delay: time.Millisecond * 10})
+
+	// Register my instance on the network
+	registrar, err := mdns.NewRegistrarWithOptions(mdns.Service{
+		Instance: "node1",
+		Service:  "_test._tcp",
+		Port:     8080,
+		Ips:      []net.IP{net.IPv4(10, 0, 0, 1)},
+	}, mdns.RegistrarOptions{Transport: network}, logger)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	registrar.Register()
+	defer registrar.Deregister()
+
+	// And discover it
+	instancer, err := mdns.NewInstancer("_test._tcp", mdns.InstancerOptions{Transport: network}, logger)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer instancer.Stop()
+	fmt.Println(instancer.State().Instances)
+
+	// Output:
+	// [10.0.0.1:8080]
+}
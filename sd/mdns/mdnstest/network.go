@@ -0,0 +1,239 @@
+// Package mdnstest provides an in-memory multicast network for the tests of the mDNS discovery,
+// which can inject packet loss, delay and duplicate packets.
+package mdnstest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conditions are the faults of the network, applied to every packet delivered to every socket.
+type Conditions struct {
+	Loss      float64       // Probability of a packet being dropped, between 0 and 1
+	Duplicate float64       // Probability of a packet being delivered twice, between 0 and 1
+	Delay     time.Duration // Delay of the packets
+	Jitter    time.Duration // Random extra delay of the packets, up to the jitter
+}
+
+// ErrClosed is returned by the operations on a closed socket.
+var ErrClosed = errors.New("mdnstest: use of closed connection")
+
+// queueSize is the number of packets a socket buffers, the others are dropped like a full socket buffer.
+const queueSize = 256
+
+// Network is an in-memory multicast segment, on which all the sockets are on the same host.
+// It implements the Transport of package mdns, the interfaces are ignored.
+type Network struct {
+	mtx        sync.Mutex
+	conditions Conditions
+	rand       *rand.Rand
+	nextPort   int
+	conns      map[*conn]bool
+}
+
+// NewNetwork returns a network without faults.
+// The faults are randomized by the seed, so a test can replay them.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:     rand.New(rand.NewSource(seed)),
+		nextPort: 49152,
+		conns:    map[*conn]bool{},
+	}
+}
+
+// SetConditions changes the faults of the network.
+func (n *Network) SetConditions(conditions Conditions) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.conditions = conditions
+}
+
+// ListenUnicast opens a socket with an ephemeral port.
+func (n *Network) ListenUnicast(iface *net.Interface, group *net.UDPAddr) (net.PacketConn, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	port := n.nextPort
+	n.nextPort++
+	return n.open(&net.UDPAddr{IP: hostIP(group), Port: port}, nil), nil
+}
+
+// ListenMulticast opens a socket joined the group, which listens on the port of the group.
+func (n *Network) ListenMulticast(iface *net.Interface, group *net.UDPAddr) (net.PacketConn, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.open(&net.UDPAddr{IP: hostIP(group), Port: group.Port}, group), nil
+}
+
+// open opens a socket, the caller must hold n.mtx.
+func (n *Network) open(addr, group *net.UDPAddr) *conn {
+	c := &conn{
+		network: n,
+		addr:    addr,
+		group:   group,
+		queue:   make(chan packet, queueSize),
+		closed:  make(chan struct{}),
+	}
+	n.conns[c] = true
+	return c
+}
+
+func (n *Network) close(c *conn) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	delete(n.conns, c)
+}
+
+// send delivers the packet to the members of the group, or to the sockets bound to the address.
+func (n *Network) send(buf []byte, from, to *net.UDPAddr) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	multicast := to.IP.IsMulticast()
+	for c := range n.conns {
+		if multicast {
+			if c.group == nil || !c.group.IP.Equal(to.IP) || c.group.Port != to.Port {
+				continue
+			}
+		} else if !c.addr.IP.Equal(to.IP) || c.addr.Port != to.Port {
+			continue
+		}
+
+		if n.rand.Float64() < n.conditions.Loss {
+			continue
+		}
+		copies := 1
+		if n.rand.Float64() < n.conditions.Duplicate {
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			delay := n.conditions.Delay
+			if n.conditions.Jitter > 0 {
+				delay += time.Duration(n.rand.Int63n(int64(n.conditions.Jitter)))
+			}
+			c.deliver(packet{buf: append([]byte{}, buf...), from: from}, delay)
+		}
+	}
+}
+
+// hostIP returns the address of the host for the IP version of the group.
+func hostIP(group *net.UDPAddr) net.IP {
+	if group.IP.To4() != nil {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	return net.IPv6loopback
+}
+
+type packet struct {
+	buf  []byte
+	from *net.UDPAddr
+}
+
+// conn is a socket of the network.
+type conn struct {
+	network *Network
+	addr    *net.UDPAddr
+	group   *net.UDPAddr // The group joined, nil for the unicast sockets
+
+	queue     chan packet
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mtx          sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *conn) deliver(p packet, delay time.Duration) {
+	enqueue := func() {
+		select {
+		case c.queue <- p:
+		case <-c.closed:
+		default: // the buffer is full
+		}
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, enqueue)
+	} else {
+		enqueue()
+	}
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mtx.Lock()
+	deadline := c.readDeadline
+	c.mtx.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-c.queue:
+		return copy(b, p.buf), p.from, nil
+	case <-c.closed:
+		return 0, nil, ErrClosed
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	}
+}
+
+// WriteTo implements net.PacketConn.
+func (c *conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.AddrError{Err: "not a udp address", Addr: addr.String()}
+	}
+	c.network.send(b, c.addr, to)
+	return len(b), nil
+}
+
+// Close implements net.PacketConn.
+func (c *conn) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.close(c)
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr implements net.PacketConn.
+func (c *conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements net.PacketConn.
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn, the writes never block.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mdnstest: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,112 @@
+package mdnstest
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+var group = &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+
+func TestNetwork(t *testing.T) {
+	network := NewNetwork(1)
+
+	sender, err := network.ListenUnicast(nil, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	var members []net.PacketConn
+	for i := 0; i < 2; i++ {
+		member, err := network.ListenMulticast(nil, group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer member.Close()
+		members = append(members, member)
+	}
+
+	// The members of the group receive the multicast packets
+	if _, err := sender.WriteTo([]byte("query"), group); err != nil {
+		t.Fatal(err)
+	}
+	var from net.Addr
+	for _, member := range members {
+		from = expectPacket(t, member, "query")
+		if want, have := sender.LocalAddr().String(), from.String(); want != have {
+			t.Errorf("want: %s have: %s", want, have)
+		}
+	}
+
+	// The unicast packets are received by the socket bound to the address only
+	if _, err := members[0].WriteTo([]byte("response"), from); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, sender, "response")
+	expectNoPacket(t, members[1])
+}
+
+func TestNetworkConditions(t *testing.T) {
+	network := NewNetwork(1)
+
+	sender, err := network.ListenUnicast(nil, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	member, err := network.ListenMulticast(nil, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer member.Close()
+
+	// Lost
+	network.SetConditions(Conditions{Loss: 1})
+	if _, err := sender.WriteTo([]byte("lost"), group); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPacket(t, member)
+
+	// Duplicated and delayed
+	network.SetConditions(Conditions{Duplicate: 1, Delay: time.Millisecond * 50})
+	begin := time.Now()
+	if _, err := sender.WriteTo([]byte("duplicate"), group); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, member, "duplicate")
+	expectPacket(t, member, "duplicate")
+	if elapsed := time.Since(begin); elapsed < time.Millisecond*50 {
+		t.Errorf("want delayed, have: %s", elapsed)
+	}
+
+	// Closed
+	member.Close()
+	if _, _, err := member.ReadFrom(make([]byte, 10)); err != ErrClosed {
+		t.Errorf("want: %v have: %v", ErrClosed, err)
+	}
+}
+
+func expectPacket(t *testing.T, conn net.PacketConn, want string) net.Addr {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := string(buf[:n]); want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+	return from
+}
+
+func expectNoPacket(t *testing.T, conn net.PacketConn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	n, _, err := conn.ReadFrom(make([]byte, 100))
+	if err == nil {
+		t.Errorf("want no packet, have %d bytes", n)
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,39 @@
+package mdns
+
+import (
+	"github.com/go-kit/kit/metrics"
+)
+
+// InstancerMetrics is used to instrument an Instancer. The nil metrics are not reported.
+type InstancerMetrics struct {
+	LookupDuration   metrics.Histogram // Seconds from the queries to the last responses, or the timeout if nothing responds
+	LookupErrors     metrics.Counter   // Failed lookups
+	EntriesReceived  metrics.Counter   // Complete entries received, counted when they are new or changed
+	InvalidEntries   metrics.Counter   // Entries dropped for having no address to publish, counted once until they become valid
+	Instances        metrics.Gauge     // Current instances, zero while the lookup errors are published
+	InstancesAdded   metrics.Counter   // Instances added since the previous publish
+	InstancesRemoved metrics.Counter   // Instances removed since the previous publish
+}
+
+// RegistrarMetrics is used to instrument a Registrar. The nil metrics are not reported.
+type RegistrarMetrics struct {
+	QueriesAnswered metrics.Counter // Questions answered for the instance
+}
+
+func addCounter(counter metrics.Counter, delta float64) {
+	if counter != nil && delta != 0 {
+		counter.Add(delta)
+	}
+}
+
+func setGauge(gauge metrics.Gauge, value float64) {
+	if gauge != nil {
+		gauge.Set(value)
+	}
+}
+
+func observeHistogram(histogram metrics.Histogram, value float64) {
+	if histogram != nil {
+		histogram.Observe(value)
+	}
+}
@@ -0,0 +1,172 @@
+package mdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Three probes 250 milliseconds apart, as per 8.1 in RFC 6762.
+	probes        = 3
+	probeInterval = time.Millisecond * 250
+)
+
+// ErrNameConflict is returned when the instance name is already in use on the network.
+var ErrNameConflict = errors.New("mdns: instance name is already in use")
+
+// probe probes for the unique records of the instance, as per 8.1 in RFC 6762.
+// It returns ErrNameConflict if any other host answers for the name,
+// or wins the simultaneous probe tiebreaking, as per 8.2 in RFC 6762.
+func probe(ctx context.Context, name string, records []dns.RR, transport Transport, iface *net.Interface, logger log.Logger) error {
+	c, err := newClient(transport, interfaces(iface), true, true, logger)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	authority := recordsOf(name, records)
+	query := &dns.Msg{
+		Question: []dns.Question{{
+			Name:   name,
+			Qtype:  dns.TypeANY,
+			Qclass: dns.ClassINET | unicastResponseBit,
+		}},
+		Ns: authority,
+	}
+
+	// A random delay before the first probe, to avoid the collision of the probes
+	delay := time.Duration(rand.Int63n(int64(probeInterval)))
+	for i := 0; i <= probes; i++ {
+		timer := time.NewTimer(delay)
+	wait:
+		for {
+			select {
+			case msg := <-c.messages():
+				if conflicts(msg, name, authority) {
+					timer.Stop()
+					return ErrNameConflict
+				}
+			case <-timer.C:
+				break wait
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+
+		if i < probes {
+			if err := c.send(query); err != nil {
+				return err
+			}
+		}
+		delay = probeInterval
+	}
+	return nil
+}
+
+// conflicts reports whether the message conflicts with our records of the name.
+func conflicts(msg *dns.Msg, name string, authority []dns.RR) bool {
+	if msg.Response {
+		// Any other answer for the name, but the goodbyes of the previous owner, such as a restarted process
+		records := make([]dns.RR, 0, len(msg.Answer)+len(msg.Extra))
+		records = append(records, msg.Answer...)
+		records = append(records, msg.Extra...)
+		for _, rr := range records {
+			if rr.Header().Ttl == 0 {
+				continue
+			}
+			if equalNames(rr.Header().Name, name) && !containsRecord(authority, rr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A simultaneous probe for the name
+	probing := false
+	for _, question := range msg.Question {
+		if equalNames(question.Name, name) {
+			probing = true
+		}
+	}
+	if !probing {
+		return false
+	}
+	return compareRecords(authority, recordsOf(name, msg.Ns)) < 0
+}
+
+// recordsOf returns the records of the name.
+func recordsOf(name string, records []dns.RR) []dns.RR {
+	var filtered []dns.RR
+	for _, rr := range records {
+		if equalNames(rr.Header().Name, name) {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+// containsRecord reports whether the records contains the record, ignoring the TTL and the cache-flush bit.
+func containsRecord(records []dns.RR, record dns.RR) bool {
+	for _, rr := range records {
+		if compareRecord(rr, record) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compareRecords compares the records lexicographically, as per 8.2 in RFC 6762.
+// The records are sorted first, and the set with the remaining records is later.
+func compareRecords(ours, theirs []dns.RR) int {
+	ours, theirs = sortRecords(ours), sortRecords(theirs)
+	for i := 0; i < len(ours) && i < len(theirs); i++ {
+		if c := compareRecord(ours[i], theirs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(ours) - len(theirs)
+}
+
+func sortRecords(records []dns.RR) []dns.RR {
+	sorted := append([]dns.RR{}, records...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return compareRecord(sorted[i], sorted[j]) < 0
+	})
+	return sorted
+}
+
+// compareRecord compares the class, the type and the rdata of the records, as per 8.2 in RFC 6762.
+func compareRecord(a, b dns.RR) int {
+	classA, classB := a.Header().Class&^cacheFlushBit, b.Header().Class&^cacheFlushBit
+	if classA != classB {
+		return int(classA) - int(classB)
+	}
+	if a.Header().Rrtype != b.Header().Rrtype {
+		return int(a.Header().Rrtype) - int(b.Header().Rrtype)
+	}
+	return bytes.Compare(rdata(a), rdata(b))
+}
+
+// rdata returns the uncompressed rdata of the record.
+func rdata(rr dns.RR) []byte {
+	buf := make([]byte, dns.Len(rr)+1)
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	nameLen, err := dns.PackDomainName(rr.Header().Name, make([]byte, 256), 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	// The name is followed by the type, the class, the TTL and the rdlength
+	return buf[nameLen+10 : off]
+}
@@ -0,0 +1,57 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestConflicts(t *testing.T) {
+	newRecords := func(hostName string, port int) (string, []dns.RR) {
+		zone, err := newZone(Service{
+			Service:  "test.probe.mdns.kit",
+			HostName: hostName,
+			Port:     port,
+			Ips:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		}, "node1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "node1.test.probe.mdns.kit.local."
+		return name, recordsOf(name, records(zone))
+	}
+	name, ours := newRecords("a.host.", 8080)
+	_, same := newRecords("a.host.", 8080)
+	_, later := newRecords("b.host.", 8080)
+	_, earlier := newRecords("0.host.", 8080)
+	_, goodbye := newRecords("a.host.", 8081)
+	for _, rr := range goodbye {
+		rr.Header().Ttl = 0
+	}
+
+	// Responses
+	if conflicts(&dns.Msg{MsgHdr: dns.MsgHdr{Response: true}, Answer: same}, name, ours) {
+		t.Error("want no conflict with the same records")
+	}
+	if !conflicts(&dns.Msg{MsgHdr: dns.MsgHdr{Response: true}, Answer: later}, name, ours) {
+		t.Error("want conflict with other records")
+	}
+	if conflicts(&dns.Msg{MsgHdr: dns.MsgHdr{Response: true}, Answer: goodbye}, name, ours) {
+		t.Error("want no conflict with the goodbye records")
+	}
+
+	// Simultaneous probes
+	probe := func(records []dns.RR) *dns.Msg {
+		return &dns.Msg{Question: []dns.Question{{Name: name, Qtype: dns.TypeANY, Qclass: dns.ClassINET}}, Ns: records}
+	}
+	if conflicts(probe(same), name, ours) {
+		t.Error("want no conflict with our own probe")
+	}
+	if !conflicts(probe(later), name, ours) {
+		t.Error("want conflict with the lexicographically later probe")
+	}
+	if conflicts(probe(earlier), name, ours) {
+		t.Error("want no conflict with the lexicographically earlier probe")
+	}
+}
@@ -1,10 +1,25 @@
 package mdns
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
-	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Unsolicited announcements sent on register, at least two and one second apart, as per 8.3 in RFC 6762.
+	announcements        = 3
+	announcementInterval = time.Second
+
+	// maxRenames limits the attempts to pick a new name.
+	maxRenames = 100
 )
 
 // Service holds the instance config.
@@ -16,62 +31,496 @@ type Service struct {
 	Port     int // Required
 	Ips      []net.IP
 	Txt      []string
+	Subtypes []string // Subtypes advertised, such as "_primary", as per 7.1 in RFC 6763
+}
+
+var (
+	// ErrAlreadyRegistered is returned when starting a registrar already started.
+	ErrAlreadyRegistered = errors.New("mdns: already registered")
+	// ErrNotRegistered is returned when stopping a registrar not started.
+	ErrNotRegistered = errors.New("mdns: not registered")
+)
+
+// ConflictPolicy decides what to do when the instance name is already in use on the network.
+type ConflictPolicy int
+
+const (
+	// ConflictFail fails the registration with ErrNameConflict.
+	ConflictFail ConflictPolicy = iota
+	// ConflictRename picks a new name, such as "name (2)".
+	ConflictRename
+)
+
+// RegistrarOptions is used to customize the registrar.
+type RegistrarOptions struct {
+	Interface *net.Interface // Multicast interface to use
+	Transport Transport      // Transport of the multicast sockets, default UDPTransport
+	Conflict  ConflictPolicy // What to do when the instance name is in use, default ConflictFail
+
+	// Responder shared with the other registrars, so many services are served from one listener.
+	// The registrar adds its service to the responder on register, and removes it on deregister,
+	// but never closes the responder. By default, the registrar starts its own responder.
+	// Interface and Transport should be the ones the responder listens on.
+	Responder *Responder
+
+	// Addresses enumerates the addresses of the instance on the interfaces, if Service.Ips is empty,
+	// and watches them for changes. By default, the addresses are resolved from the host name.
+	Addresses *AddressOptions
+
+	Metrics RegistrarMetrics // Instruments the registrar
+
+	// SigningKey signs the announcements with HMAC-SHA256, the signature and the timestamp are added to the TXT
+	// records, and verified by the instancers with the same key, see InstancerOptions.SigningKey.
+	SigningKey []byte
+	// SignatureInterval is the interval the records are signed again and announced, default 5 minutes.
+	// It must be shorter than the InstancerOptions.MaxSignatureAge of the instancers.
+	SignatureInterval time.Duration
 }
 
 // Registrar is used to listen for mDNS queries and respond if we have a matching local record.
+// It probes for the instance name and announces the instance on register, and says goodbye on deregister.
 type Registrar struct {
-	config *mdns.Config
-	server *mdns.Server
+	service Service
+	opts    RegistrarOptions
+	watch   bool // Watch the discovered addresses
+
+	mtx       sync.Mutex
+	responder *Responder
+	stop      chan struct{} // Stops the background goroutines, nil after Stop begins
+	done      chan struct{} // Closed when the background goroutines have returned
+
+	zoneMtx sync.RWMutex // Guards zone, which is swapped on TXT updates
+	zone    *serviceZone
 
 	logger log.Logger
 }
 
 // NewRegistrar is used to create a new registrar from a service config.
 func NewRegistrar(service Service, logger log.Logger) (*Registrar, error) {
-	zone, err := mdns.NewMDNSService(service.Instance, service.Service,
-		service.Domain, service.HostName, service.Port, service.Ips, service.Txt)
-	if err != nil {
-		return nil, err
+	return NewRegistrarWithOptions(service, RegistrarOptions{}, logger)
+}
+
+// NewRegistrarWithOptions is used to create a new registrar from a service config and options.
+func NewRegistrarWithOptions(service Service, opts RegistrarOptions, logger log.Logger) (*Registrar, error) {
+	watch := false
+	if len(service.Ips) == 0 && opts.Addresses != nil {
+		ips, err := opts.Addresses.discover()
+		if err != nil {
+			return nil, err
+		}
+		service.Ips = ips
+		watch = opts.Addresses.WatchInterval >= 0
 	}
 
-	config := &mdns.Config{
-		Zone: zone,
+	if opts.SignatureInterval == 0 {
+		opts.SignatureInterval = defaultSignatureInterval
 	}
+
 	registrar := &Registrar{
-		config: config,
-		logger: logger,
+		service: service,
+		opts:    opts,
+		watch:   watch,
+		logger:  logger,
+	}
+	zone, err := registrar.newZone(service, service.Instance)
+	if err != nil {
+		return nil, err
 	}
+	registrar.zone = zone
 	return registrar, nil
 }
 
-// Register is used to listen for mDNS queries.
-func (registrar *Registrar) Register() {
-	if registrar.server != nil {
-		registrar.logger.Log("action", "register", "err", "already registered")
-		return
+// NewListenerRegistrar is used to create a new registrar for the service served on the listener.
+// The port, and the IP if the listener is not bound to the unspecified address, are taken from the listener,
+// so the listener can be bound to port 0, and the OS chooses the port.
+// Serve on the same listener, such as fasthttp.Server.Serve(ln).
+func NewListenerRegistrar(service Service, ln net.Listener, opts RegistrarOptions, logger log.Logger) (*Registrar, error) {
+	return NewAddrRegistrar(service, ln.Addr(), opts, logger)
+}
+
+// NewAddrRegistrar is used to create a new registrar for the service served on the listener address.
+// See NewListenerRegistrar.
+func NewAddrRegistrar(service Service, addr net.Addr, opts RegistrarOptions, logger log.Logger) (*Registrar, error) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, service.Port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, service.Port = addr.IP, addr.Port
+	default:
+		host, port, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil, err
+		}
+		service.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener port: %s", port)
+		}
+		ip = net.ParseIP(host)
 	}
 
-	server, err := mdns.NewServer(registrar.config)
+	if ip != nil && !ip.IsUnspecified() {
+		service.Ips = []net.IP{ip}
+	}
+	return NewRegistrarWithOptions(service, opts, logger)
+}
+
+// Instance returns the instance name, which may be renamed on conflict.
+func (registrar *Registrar) Instance() string {
+	return registrar.currentZone().Instance
+}
+
+func (registrar *Registrar) currentZone() *serviceZone {
+	registrar.zoneMtx.RLock()
+	defer registrar.zoneMtx.RUnlock()
+	return registrar.zone
+}
+
+func (registrar *Registrar) setZone(zone *serviceZone) {
+	registrar.zoneMtx.Lock()
+	defer registrar.zoneMtx.Unlock()
+	registrar.zone = zone
+}
+
+// UpdateTxt replaces the TXT records of the instance,
+// and announces them if the instance is registered, so the browsing peers pick up the change quickly.
+// For example, set a draining flag before deregistering.
+func (registrar *Registrar) UpdateTxt(txt []string) error {
+	registrar.mtx.Lock()
+	defer registrar.mtx.Unlock()
+
+	service := registrar.service
+	service.Txt = append([]string{}, txt...)
+	_, zone, err := registrar.swapZone(service)
+	if err != nil || registrar.responder == nil {
+		return err
+	}
+	return registrar.responder.announce(txtRecords(zone))
+}
+
+// newZone returns the zone of the service, whose TXT records are signed if the signing key is set.
+func (registrar *Registrar) newZone(service Service, instance string) (*serviceZone, error) {
+	zone, err := newZone(service, instance)
 	if err != nil {
-		registrar.logger.Log("action", "register", "err", err)
-		return
+		return nil, err
+	}
+	if len(registrar.opts.SigningKey) > 0 {
+		zone.TXT = signTxt(registrar.opts.SigningKey, zone, time.Now())
 	}
+	return zone, nil
+}
+
+// resign signs the records again and announces them at intervals, until stopped.
+func (registrar *Registrar) resign(stop <-chan struct{}) {
+	ticker := time.NewTicker(registrar.opts.SignatureInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
 
-	registrar.server = server
+		if err := registrar.resignTxt(stop); err != nil {
+			registrar.logger.Log("action", "announce", "err", err)
+		}
+	}
 }
 
-// Deregister is used to shutdown the listener.
-func (registrar *Registrar) Deregister() {
-	if registrar.server == nil {
-		registrar.logger.Log("action", "deregister", "err", "not registered")
-		return
+func (registrar *Registrar) resignTxt(stop <-chan struct{}) error {
+	registrar.mtx.Lock()
+	defer registrar.mtx.Unlock()
+
+	select {
+	case <-stop:
+		return nil // stopped while waiting for the lock
+	default:
+	}
+	_, zone, err := registrar.swapZone(registrar.service)
+	if err != nil {
+		return err
 	}
+	return registrar.responder.announce(txtRecords(zone))
+}
 
-	err := registrar.server.Shutdown()
+// swapZone replaces the zone with a new one of the service, keeping the instance name.
+// The caller must hold registrar.mtx.
+func (registrar *Registrar) swapZone(service Service) (old, zone *serviceZone, err error) {
+	old = registrar.currentZone()
+	zone, err = registrar.newZone(service, old.Instance)
 	if err != nil {
-		registrar.logger.Log("action", "deregister", "err", err)
-		return
+		return nil, nil, err
+	}
+	registrar.service = service
+
+	if registrar.responder != nil {
+		registrar.responder.replace(old, zone)
+	}
+	registrar.setZone(zone)
+	return old, zone, nil
+}
+
+// watchAddresses discovers the addresses at intervals, until stopped.
+func (registrar *Registrar) watchAddresses(stop <-chan struct{}) {
+	interval := registrar.opts.Addresses.WatchInterval
+	if interval == 0 {
+		interval = defaultWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		ips, err := registrar.opts.Addresses.discover()
+		if err != nil {
+			registrar.logger.Log("action", "discover", "err", err)
+			continue
+		}
+		if err := registrar.updateAddresses(stop, ips); err != nil {
+			registrar.logger.Log("action", "announce", "err", err)
+		}
+	}
+}
+
+// updateAddresses replaces the addresses of the instance if changed,
+// says goodbye to the removed address records, and announces the new ones.
+func (registrar *Registrar) updateAddresses(stop <-chan struct{}, ips []net.IP) error {
+	registrar.mtx.Lock()
+	defer registrar.mtx.Unlock()
+
+	select {
+	case <-stop:
+		return nil // stopped while discovering
+	default:
+	}
+	if equalIPs(sortIPs(registrar.service.Ips), ips) {
+		return nil
+	}
+
+	service := registrar.service
+	service.Ips = ips
+	old, zone, err := registrar.swapZone(service)
+	if err != nil {
+		return err
+	}
+
+	var removed []dns.RR
+	for _, rr := range addressRecords(old) {
+		if !containsRecord(addressRecords(zone), rr) {
+			removed = append(removed, rr)
+		}
+	}
+	if len(removed) > 0 {
+		if err := registrar.responder.goodbye(removed); err != nil {
+			return err
+		}
+	}
+	records := addressRecords(zone)
+	if len(registrar.opts.SigningKey) > 0 {
+		records = append(records, txtRecords(zone)...) // the signed addresses
+	}
+	return registrar.responder.announce(records)
+}
+
+// Start probes for the instance name, listens for mDNS queries, and announces the instance.
+// It blocks until the initial announcements have gone out, and reports the bind, probe and announcement failures.
+// If ctx is done before, the instance says goodbye and Start returns ctx.Err().
+func (registrar *Registrar) Start(ctx context.Context) error {
+	announced, err := registrar.start(ctx)
+	if err != nil {
+		return err
 	}
 
-	registrar.server = nil
+	select {
+	case err = <-announced:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		if stopErr := registrar.Stop(context.Background()); stopErr != nil {
+			registrar.logger.Log("action", "deregister", "err", stopErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Register implements sd.Registrar. It starts the registrar without waiting for the announcements.
+// The failures are logged.
+func (registrar *Registrar) Register() {
+	if _, err := registrar.start(context.Background()); err != nil {
+		registrar.logger.Log("action", "register", "err", err)
+	}
+}
+
+// start starts the responder and the announcements,
+// the result of the announcements is sent to the returned channel.
+func (registrar *Registrar) start(ctx context.Context) (<-chan error, error) {
+	registrar.mtx.Lock()
+	defer registrar.mtx.Unlock()
+
+	if registrar.responder != nil {
+		return nil, ErrAlreadyRegistered
+	}
+
+	if err := registrar.probe(ctx); err != nil {
+		return nil, err
+	}
+
+	responder := registrar.opts.Responder
+	if responder == nil {
+		var err error
+		responder, err = NewResponderWithOptions(ResponderOptions{
+			Interface: registrar.opts.Interface,
+			Transport: registrar.opts.Transport,
+		}, registrar.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	responder.add(registrar.currentZone(), registrar.opts.Metrics.QueriesAnswered)
+
+	announced := make(chan error, 1)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		registrar.announce(responder, stop, announced)
+	}()
+	if registrar.watch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			registrar.watchAddresses(stop)
+		}()
+	}
+	if len(registrar.opts.SigningKey) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			registrar.resign(stop)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	registrar.responder = responder
+	registrar.stop, registrar.done = stop, done
+	return announced, nil
+}
+
+// probe probes for the instance name, and picks a new name on conflict if the policy allows it.
+func (registrar *Registrar) probe(ctx context.Context) error {
+	for i := 1; ; i++ {
+		zone := registrar.currentZone()
+		if i > 1 {
+			var err error
+			zone, err = registrar.newZone(registrar.service, fmt.Sprintf("%s (%d)", registrar.service.Instance, i))
+			if err != nil {
+				return err
+			}
+		}
+
+		err := probe(ctx, zone.instanceAddr(), records(zone), defaultTransport(registrar.opts.Transport), registrar.opts.Interface, registrar.logger)
+		if err == ErrNameConflict && registrar.opts.Conflict == ConflictRename && i < maxRenames {
+			registrar.logger.Log("action", "probe", "instance", zone.Instance, "err", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		registrar.setZone(zone)
+		return nil
+	}
+}
+
+// announce sends the unsolicited announcements, the interval between them doubles.
+// The first failure, or nil, is sent to announced when the announcements are done or stopped.
+func (registrar *Registrar) announce(responder *Responder, stop <-chan struct{}, announced chan<- error) {
+	var firstErr error
+	defer func() {
+		announced <- firstErr
+	}()
+
+	interval := announcementInterval
+	for i := 0; i < announcements; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+				interval *= 2
+			case <-stop:
+				return
+			}
+		}
+
+		if err := responder.announce(records(registrar.currentZone())); err != nil {
+			registrar.logger.Log("action", "announce", "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+}
+
+// Stop says goodbye, and shutdowns the listener unless it is shared.
+// ctx bounds the wait for the background goroutines and the goodbye,
+// if it is done before, the listener is shut down without saying goodbye, and Stop returns ctx.Err().
+func (registrar *Registrar) Stop(ctx context.Context) error {
+	registrar.mtx.Lock()
+	defer registrar.mtx.Unlock()
+
+	if registrar.responder == nil || registrar.stop == nil {
+		return ErrNotRegistered
+	}
+
+	// The goroutines may be waiting for the lock, they return once they get it and see stop closed.
+	close(registrar.stop)
+	registrar.stop = nil
+	registrar.mtx.Unlock()
+	var err error
+	select {
+	case <-registrar.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	registrar.mtx.Lock()
+
+	zone := registrar.currentZone()
+	if err == nil {
+		sent := make(chan error, 1)
+		go func(responder *Responder) {
+			sent <- responder.goodbye(records(zone))
+		}(registrar.responder)
+		select {
+		case err = <-sent:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	registrar.responder.remove(zone)
+	if registrar.opts.Responder == nil {
+		if closeErr := registrar.responder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	registrar.responder = nil
+	return err
+}
+
+// Deregister implements sd.Registrar. It stops the registrar, and the failures are logged.
+func (registrar *Registrar) Deregister() {
+	if err := registrar.Stop(context.Background()); err != nil {
+		registrar.logger.Log("action", "deregister", "err", err)
+	}
 }
@@ -1,6 +1,7 @@
 package mdns
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
@@ -8,8 +9,10 @@ import (
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
 	"github.com/hashicorp/mdns"
 )
 
@@ -83,3 +86,400 @@ func TestRegistrar(t *testing.T) {
 		t.Errorf("want: %s have: %s", want, have)
 	}
 }
+
+func TestRegistrarAnnouncement(t *testing.T) {
+	serviceName := "test.announcement.mdns.kit"
+
+	// Create the mDNS instancer, which never refreshes during the test
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		Browse:          true,
+		RefreshInterval: time.Hour,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	eventsCh := make(chan sd.Event, 10)
+	instancer.Register(eventsCh)
+	defer instancer.Deregister(eventsCh)
+	expectInstances(t, eventsCh, nil)
+
+	registrar, instance, err := newTestRegistrar(serviceName, rand.Intn(1000)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Peers learn about the instance from the announcement
+	registrar.Register()
+	expectInstances(t, eventsCh, []string{instance})
+
+	// And forget it on the goodbye
+	registrar.Deregister()
+	expectInstances(t, eventsCh, nil)
+}
+
+func TestRegistrarConflict(t *testing.T) {
+	serviceName := "test.conflict.mdns.kit"
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+
+	newRegistrar := func(port int, conflict ConflictPolicy) *Registrar {
+		registrar, err := NewRegistrarWithOptions(Service{
+			Instance: "node1",
+			Service:  serviceName,
+			HostName: fmt.Sprintf("host%d.", port),
+			Port:     port,
+			Ips:      ips,
+		}, RegistrarOptions{Conflict: conflict}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return registrar
+	}
+
+	first := newRegistrar(8081, ConflictFail)
+	first.Register()
+	defer first.Deregister()
+	if first.responder == nil {
+		t.Fatal("want registered")
+	}
+
+	// Fails on conflict
+	second := newRegistrar(8082, ConflictFail)
+	second.Register()
+	if second.responder != nil {
+		second.Deregister()
+		t.Fatal("want conflict")
+	}
+
+	// Picks a new name on conflict
+	third := newRegistrar(8083, ConflictRename)
+	third.Register()
+	defer third.Deregister()
+	if third.responder == nil {
+		t.Fatal("want registered")
+	}
+	if want, have := "node1 (2)", third.Instance(); want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	// The renamed names conflict too
+	fourth := newRegistrar(8084, ConflictRename)
+	fourth.Register()
+	defer fourth.Deregister()
+	if fourth.responder == nil {
+		t.Fatal("want registered")
+	}
+	if want, have := "node1 (3)", fourth.Instance(); want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
+
+func TestRegistrarStart(t *testing.T) {
+	serviceName := "test.start.mdns.kit"
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+
+	newRegistrar := func(instance string, port int) *Registrar {
+		registrar, err := NewRegistrar(Service{
+			Instance: instance,
+			Service:  serviceName,
+			HostName: fmt.Sprintf("host%d.", port),
+			Port:     port,
+			Ips:      ips,
+		}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return registrar
+	}
+
+	first := newRegistrar("node1", 8081)
+	if err := first.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := ErrAlreadyRegistered, first.Start(context.Background()); want != have {
+		t.Errorf("want: %v have: %v", want, have)
+	}
+
+	// Reports the conflict
+	second := newRegistrar("node1", 8082)
+	if want, have := ErrNameConflict, second.Start(context.Background()); want != have {
+		t.Errorf("want: %v have: %v", want, have)
+	}
+
+	// Gives up when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	third := newRegistrar("node3", 8083)
+	if want, have := context.DeadlineExceeded, third.Start(ctx); want != have {
+		t.Errorf("want: %v have: %v", want, have)
+	}
+
+	if err := first.Stop(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if want, have := ErrNotRegistered, first.Stop(context.Background()); want != have {
+		t.Errorf("want: %v have: %v", want, have)
+	}
+}
+
+func TestRegistrarStop(t *testing.T) {
+	registrar, err := NewRegistrarWithOptions(Service{
+		Instance: "node1",
+		Service:  "test.stop.mdns.kit",
+		Port:     8081,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)}, // Just for test
+	}, RegistrarOptions{
+		SigningKey:        []byte("secret"),
+		SignatureInterval: time.Millisecond, // keeps resigning while stopping
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := registrar.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		done := registrar.done
+		if err := registrar.Stop(context.Background()); err != nil {
+			t.Error(err)
+		}
+		select {
+		case <-done:
+		default:
+			t.Error("want the background goroutines returned")
+		}
+	}
+
+	// The goodbye is not sent when the context is done, but the registrar is stopped anyway
+	registrar.Register()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := registrar.Stop(ctx); err != nil && err != context.Canceled {
+		t.Error(err)
+	}
+	if want, have := ErrNotRegistered, registrar.Stop(context.Background()); want != have {
+		t.Errorf("want: %v have: %v", want, have)
+	}
+}
+
+func TestRegistrarSharedResponder(t *testing.T) {
+	serviceNames := []string{"test.http.shared.mdns.kit", "test.metrics.shared.mdns.kit"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1)} // Just for test
+
+	responder, err := NewResponder(nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+
+	var registrars []*Registrar
+	for i, serviceName := range serviceNames {
+		registrar, err := NewRegistrarWithOptions(Service{
+			Instance: "node1",
+			Service:  serviceName,
+			Port:     8081 + i,
+			Ips:      ips,
+		}, RegistrarOptions{Responder: responder}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := registrar.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		registrars = append(registrars, registrar)
+	}
+
+	// One responder answers for all the services
+	for i, serviceName := range serviceNames {
+		instancer, err := NewInstancer(serviceName, InstancerOptions{}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sd.Event{Instances: []string{fmt.Sprintf("127.0.0.1:%d", 8081+i)}}
+		if have := instancer.State(); !reflect.DeepEqual(want, have) {
+			t.Errorf("want: %v have: %v", want, have)
+		}
+		instancer.Stop()
+	}
+
+	// And keeps answering for the others after a service is removed
+	if err := registrars[0].Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer registrars[1].Deregister()
+	for i, serviceName := range serviceNames {
+		instancer, err := NewInstancer(serviceName, InstancerOptions{}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sd.Event{Instances: []string{}}
+		if i > 0 {
+			want.Instances = []string{fmt.Sprintf("127.0.0.1:%d", 8081+i)}
+		}
+		if have := instancer.State(); !reflect.DeepEqual(want, have) {
+			t.Errorf("want: %v have: %v", want, have)
+		}
+		instancer.Stop()
+	}
+}
+
+func TestRegistrarUpdateTxt(t *testing.T) {
+	serviceName := "test.txt.mdns.kit"
+
+	// Create the mDNS instancer, which never refreshes during the test
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		Browse:          true,
+		RefreshInterval: time.Hour,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	entriesCh := make(chan EntryEvent, 10)
+	instancer.RegisterEntries(entriesCh)
+	defer instancer.DeregisterEntries(entriesCh)
+
+	expectTxt := func(want map[string]string) {
+		t.Helper()
+		timeout := time.After(time.Second * 2)
+		for {
+			select {
+			case event := <-entriesCh:
+				if len(event.Entries) == 1 && reflect.DeepEqual(want, event.Entries[0].Txt) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("did not receive expected txt %v", want)
+			}
+		}
+	}
+
+	registrar, err := NewRegistrar(Service{
+		Instance: "node1",
+		Service:  serviceName,
+		Port:     8081,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)}, // Just for test
+		Txt:      []string{"version=1"},
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registrar.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer registrar.Deregister()
+	expectTxt(map[string]string{"version": "1"})
+
+	// Peers learn about the new TXT records from the announcement
+	if err := registrar.UpdateTxt([]string{"version=1", "draining=true"}); err != nil {
+		t.Fatal(err)
+	}
+	expectTxt(map[string]string{"version": "1", "draining": "true"})
+}
+
+func TestRegistrarAddresses(t *testing.T) {
+	serviceName := "test.addresses.mdns.kit"
+
+	// Create the mDNS instancer, which never refreshes during the test
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		Browse:          true,
+		RefreshInterval: time.Hour,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	eventsCh := make(chan sd.Event, 10)
+	instancer.Register(eventsCh)
+	defer instancer.Deregister(eventsCh)
+	expectInstances(t, eventsCh, nil)
+
+	// The addresses are discovered on the interfaces
+	registrar, err := NewRegistrarWithOptions(Service{
+		Instance: "node1",
+		Service:  serviceName,
+		HostName: "test.host.",
+		Port:     8081,
+	}, RegistrarOptions{
+		Addresses: &AddressOptions{Loopback: true, Interfaces: []string{"lo*"}, WatchInterval: -1},
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	discovered := false
+	for _, ip := range registrar.service.Ips {
+		discovered = discovered || ip.Equal(net.IPv4(127, 0, 0, 1))
+	}
+	if !discovered {
+		t.Fatalf("want: 127.0.0.1 have: %s", registrar.service.Ips)
+	}
+	if err := registrar.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer registrar.Deregister()
+	expectInstances(t, eventsCh, []string{"127.0.0.1:8081"})
+
+	// Peers learn about the changed addresses
+	if err := registrar.updateAddresses(registrar.stop, []net.IP{net.IPv4(127, 0, 0, 2)}); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-eventsCh:
+			if reflect.DeepEqual([]string{"127.0.0.2:8081"}, event.Instances) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("did not receive the changed addresses")
+		}
+	}
+}
+
+func TestListenerRegistrar(t *testing.T) {
+	// The OS chooses the port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	registrar, err := NewListenerRegistrar(Service{
+		Instance: "node1",
+		Service:  "test.listener.mdns.kit",
+	}, ln, RegistrarOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := ln.Addr().(*net.TCPAddr).Port, registrar.service.Port; want != have {
+		t.Errorf("want: %d have: %d", want, have)
+	}
+	if want, have := []net.IP{net.IPv4(127, 0, 0, 1).To4()}, registrar.service.Ips; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	// The addresses of the unspecified IP are not taken
+	registrar, err = NewAddrRegistrar(Service{
+		Instance: "node1",
+		Service:  "test.listener.mdns.kit",
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)}, // Just for test
+	}, fakeAddr("[::]:8081"), RegistrarOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 8081, registrar.service.Port; want != have {
+		t.Errorf("want: %d have: %d", want, have)
+	}
+	if want, have := []net.IP{net.IPv4(127, 0, 0, 1)}, registrar.service.Ips; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
+
+type fakeAddr string
+
+func (addr fakeAddr) Network() string { return "fake" }
+func (addr fakeAddr) String() string  { return string(addr) }
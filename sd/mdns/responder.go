@@ -0,0 +1,278 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	// cacheFlushBit is the top bit of the rrclass, as per 10.2 in RFC 6762.
+	// It is set in the unique records of the announcements.
+	cacheFlushBit = 1 << 15
+	// unicastResponseBit is the top bit of the qclass, as per 5.4 in RFC 6762.
+	unicastResponseBit = 1 << 15
+)
+
+// Responder listens for mDNS queries and responds if we have a matching local record.
+// It also multicasts the unsolicited announcements.
+// A Responder can be shared by many registrars, see RegistrarOptions.Responder,
+// the services are added and removed as the registrars register and deregister.
+type Responder struct {
+	zones *zoneSet
+	conns []*mdnsConn
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+
+	logger log.Logger
+}
+
+// ResponderOptions is used to customize the responder.
+type ResponderOptions struct {
+	Interface *net.Interface // Multicast interface to use, uses system default if not provided
+	Transport Transport      // Transport of the multicast sockets, default UDPTransport
+}
+
+// NewResponder starts a responder listening on the interface, uses system default if not provided.
+// It answers for no services until the registrars are registered.
+func NewResponder(iface *net.Interface, logger log.Logger) (*Responder, error) {
+	return NewResponderWithOptions(ResponderOptions{Interface: iface}, logger)
+}
+
+// NewResponderWithOptions starts a responder with the options.
+// It answers for no services until the registrars are registered.
+func NewResponderWithOptions(opts ResponderOptions, logger log.Logger) (*Responder, error) {
+	conns, err := listenMulticast(defaultTransport(opts.Transport), interfaces(opts.Interface))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Responder{
+		zones:  &zoneSet{},
+		conns:  conns,
+		closed: make(chan struct{}),
+		logger: logger,
+	}
+	for _, conn := range conns {
+		r.wg.Add(1)
+		go r.recv(conn)
+	}
+	return r, nil
+}
+
+// recv receives the queries until the responder is shutdown.
+func (r *Responder) recv(conn *mdnsConn) {
+	defer r.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-r.closed:
+				return
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			r.logger.Log("action", "receive", "err", err)
+			return
+		}
+
+		var query dns.Msg
+		if err := query.Unpack(buf[:n]); err != nil {
+			r.logger.Log("action", "receive", "err", err)
+			continue
+		}
+		if err := r.handleQuery(&query, from, conn); err != nil {
+			r.logger.Log("action", "respond", "err", err)
+		}
+	}
+}
+
+// handleQuery answers the questions of the query.
+// The answers are multicast, unless the unicast response is desired or the query is a legacy unicast query.
+func (r *Responder) handleQuery(query *dns.Msg, from net.Addr, conn *mdnsConn) error {
+	if query.Response {
+		return nil // responses of the other responders
+	}
+	if query.Opcode != dns.OpcodeQuery || query.Rcode != dns.RcodeSuccess {
+		// Multicast DNS messages received with non-zero OPCODE or RCODE MUST be silently ignored,
+		// as per 18.3 and 18.11 in RFC 6762.
+		return nil
+	}
+
+	var multicastAnswer, unicastAnswer []dns.RR
+	for _, question := range query.Question {
+		records := r.zones.answer(question)
+		if question.Qclass&unicastResponseBit != 0 {
+			unicastAnswer = append(unicastAnswer, records...)
+		} else {
+			multicastAnswer = append(multicastAnswer, records...)
+		}
+	}
+
+	// Queries not sent from the mDNS port are legacy unicast queries,
+	// their responses are sent back directly, as per 6.7 in RFC 6762.
+	if addr, ok := from.(*net.UDPAddr); ok && addr.Port != mdnsPort {
+		unicastAnswer = append(unicastAnswer, multicastAnswer...)
+		multicastAnswer = nil
+	}
+
+	if len(multicastAnswer) > 0 {
+		if err := r.send(newResponse(multicastAnswer), []*mdnsConn{conn}); err != nil {
+			return fmt.Errorf("error sending multicast response: %v", err)
+		}
+	}
+	if len(unicastAnswer) > 0 {
+		resp := newResponse(unicastAnswer)
+		resp.Id = query.Id
+		resp.Question = query.Question
+		buf, err := resp.Pack()
+		if err != nil {
+			return err
+		}
+		if _, err := conn.WriteTo(buf, from); err != nil {
+			return fmt.Errorf("error sending unicast response: %v", err)
+		}
+	}
+	return nil
+}
+
+// announce multicasts the records as an unsolicited response.
+// The unique records are announced with the cache-flush bit.
+func (r *Responder) announce(records []dns.RR) error {
+	for _, rr := range records {
+		if rr.Header().Rrtype != dns.TypePTR {
+			rr.Header().Class |= cacheFlushBit
+		}
+	}
+	return r.send(newResponse(records), r.conns)
+}
+
+// goodbye multicasts the records with zero TTL, as per 10.1 in RFC 6762.
+func (r *Responder) goodbye(records []dns.RR) error {
+	for _, rr := range records {
+		rr.Header().Ttl = 0
+	}
+	return r.send(newResponse(records), r.conns)
+}
+
+func (r *Responder) send(msg *dns.Msg, conns []*mdnsConn) error {
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	return sendMulticast(conns, buf)
+}
+
+// add starts answering for the zone, the answered questions are counted if the counter is not nil.
+func (r *Responder) add(zone mdns.Zone, answered metrics.Counter) {
+	r.zones.add(zone, answered)
+}
+
+// remove stops answering for the zone.
+func (r *Responder) remove(zone mdns.Zone) {
+	r.zones.remove(zone)
+}
+
+// replace swaps the zone for the new one atomically.
+func (r *Responder) replace(old, zone mdns.Zone) {
+	r.zones.replace(old, zone)
+}
+
+// Close closes the listeners.
+// The registrars sharing the responder should be deregistered first, so they say goodbye.
+func (r *Responder) Close() error {
+	close(r.closed)
+	closeConns(r.conns)
+	r.wg.Wait()
+	return nil
+}
+
+// zoneSet is a composite zone, which answers for all the zones.
+type zoneSet struct {
+	mtx   sync.RWMutex
+	zones []zoneEntry
+}
+
+type zoneEntry struct {
+	zone     mdns.Zone
+	answered metrics.Counter // Questions answered by the zone, may be nil
+}
+
+func (s *zoneSet) add(zone mdns.Zone, answered metrics.Counter) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.zones = append(s.zones, zoneEntry{zone: zone, answered: answered})
+}
+
+func (s *zoneSet) remove(zone mdns.Zone) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, entry := range s.zones {
+		if entry.zone == zone {
+			s.zones = append(s.zones[:i:i], s.zones[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *zoneSet) replace(old, zone mdns.Zone) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, entry := range s.zones {
+		if entry.zone == old {
+			s.zones[i].zone = zone
+			return
+		}
+	}
+	s.zones = append(s.zones, zoneEntry{zone: zone})
+}
+
+// Records implements mdns.Zone.
+func (s *zoneSet) Records(q dns.Question) []dns.RR {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var records []dns.RR
+	for _, entry := range s.zones {
+		records = append(records, entry.zone.Records(q)...)
+	}
+	return records
+}
+
+// answer returns the records of all the zones for the question of a query,
+// and counts the question answered by the zones.
+func (s *zoneSet) answer(q dns.Question) []dns.RR {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var records []dns.RR
+	for _, entry := range s.zones {
+		answer := entry.zone.Records(q)
+		if len(answer) > 0 {
+			addCounter(entry.answered, 1)
+		}
+		records = append(records, answer...)
+	}
+	return records
+}
+
+// newResponse returns a response with the answers, see section 18 of RFC 6762 for rules about DNS headers.
+func newResponse(answer []dns.RR) *dns.Msg {
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response:      true,
+			Opcode:        dns.OpcodeQuery,
+			Authoritative: true,
+		},
+		Compress: true,
+		Answer:   answer,
+	}
+}
@@ -0,0 +1,71 @@
+package mdns
+
+import (
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	entry := Entry{Txt: map[string]string{"env": "prod", "version": "v2", "canary": ""}}
+
+	for _, testcase := range []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env==prod", true},
+		{"env=dev", false},
+		{"env!=dev", true},
+		{"zone!=a", true},
+		{"env=prod,version in (v2,v3)", true},
+		{"env=prod, version in (v3, v4)", false},
+		{"version notin (v3,v4)", true},
+		{"zone notin (a)", true},
+		{"canary", true},
+		{"!canary", false},
+		{"!zone", true},
+		{"zone", false},
+	} {
+		selector, err := ParseSelector(testcase.expr)
+		if err != nil {
+			t.Errorf("expr: %q err: %v", testcase.expr, err)
+			continue
+		}
+		if have := selector.Matches(entry); testcase.want != have {
+			t.Errorf("expr: %q want: %v have: %v", testcase.expr, testcase.want, have)
+		}
+	}
+}
+
+func TestParseInvalidSelector(t *testing.T) {
+	for _, expr := range []string{
+		"env=prod,",
+		"env=prod=dev",
+		"version in ()",
+		"version in (v1,,v2)",
+		"version in v1",
+		"(env)",
+	} {
+		if _, err := ParseSelector(expr); err == nil {
+			t.Errorf("expr: %q want error", expr)
+		}
+	}
+}
+
+func TestLabelSelectorUnmatched(t *testing.T) {
+	selector, err := ParseSelector("env=prod,version in (v2,v3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "env=prod,version in (v2,v3)", selector.(labelSelector).String(); want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	r, ok := selector.(labelSelector).unmatched(Entry{Txt: map[string]string{"env": "prod", "version": "v1"}})
+	if !ok {
+		t.Fatal("want unmatched requirement")
+	}
+	if want, have := "version in (v2,v3)", r.String(); want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
@@ -0,0 +1,112 @@
+package mdns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The TXT keys of the signed announcements
+const (
+	signatureKey = "sig"   // HMAC-SHA256 of the instance, in base64 URL encoding
+	timestampKey = "ts"    // Unix time of the signature
+	addressesKey = "addrs" // Addresses of the instance, separated by commas
+)
+
+const (
+	defaultSignatureInterval = time.Minute * 5
+	defaultMaxSignatureAge   = time.Minute * 10
+)
+
+var (
+	errUnsigned       = errors.New("mdns: unsigned entry")
+	errBadSignature   = errors.New("mdns: invalid signature")
+	errStaleSignature = errors.New("mdns: stale signature")
+	errBadAddress     = errors.New("mdns: address not signed")
+)
+
+// signTxt returns the TXT records of the zone, signed by the key at the time.
+// The previous signature of the records is replaced.
+func signTxt(key []byte, zone *serviceZone, now time.Time) []string {
+	ips := make([]string, 0, len(zone.IPs))
+	for _, ip := range sortIPs(zone.IPs) {
+		ips = append(ips, ip.String())
+	}
+
+	txt := make([]string, 0, len(zone.TXT)+3)
+	for _, field := range zone.TXT {
+		switch strings.SplitN(field, "=", 2)[0] {
+		case signatureKey, timestampKey, addressesKey:
+		default:
+			txt = append(txt, field)
+		}
+	}
+	txt = append(txt,
+		addressesKey+"="+strings.Join(ips, ","),
+		timestampKey+"="+strconv.FormatInt(now.Unix(), 10))
+
+	signature := sign(key, zone.Service, zone.Instance, zone.HostName, zone.Port, parseTxt(txt))
+	return append(txt, signatureKey+"="+signature)
+}
+
+// verifyEntry verifies the signature of the entry, which is signed by the key no longer than maxAge ago,
+// and the addresses of the entry are signed.
+func verifyEntry(key []byte, service string, entry Entry, now time.Time, maxAge time.Duration) error {
+	signature, ok := entry.Txt[signatureKey]
+	if !ok {
+		return errUnsigned
+	}
+	want := sign(key, service, entry.Name, entry.Host, entry.Port, entry.Txt)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return errBadSignature
+	}
+
+	timestamp, err := strconv.ParseInt(entry.Txt[timestampKey], 10, 64)
+	if err != nil {
+		return errBadSignature
+	}
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > maxAge || age < -maxAge {
+		return errStaleSignature
+	}
+
+	signed := map[string]bool{}
+	for _, ip := range strings.Split(entry.Txt[addressesKey], ",") {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			signed[parsed.String()] = true
+		}
+	}
+	for _, ip := range []net.IP{entry.AddrV4, entry.AddrV6} {
+		if ip != nil && !signed[ip.String()] {
+			return errBadAddress
+		}
+	}
+	return nil
+}
+
+// sign returns the signature of the instance of the service, with the TXT key/value pairs except the signature.
+// The names are signed in the canonical form, so the unescaped names of the registrars,
+// and the escaped names unpacked by the instancers, have the same signature.
+func sign(key []byte, service, instance, host string, port int, txt map[string]string) string {
+	keys := make([]string, 0, len(txt))
+	for k := range txt {
+		if k != signatureKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n", canonicalName(service), canonicalName(instance), canonicalName(host), port)
+	for _, k := range keys {
+		fmt.Fprintf(mac, "%s=%s\n", k, txt[k])
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
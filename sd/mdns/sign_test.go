@@ -0,0 +1,91 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSignature(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+	zone, err := newZone(Service{
+		Service:  "test.sign.mdns.kit",
+		HostName: "test.host.",
+		Port:     8080,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1), net.ParseIP("::1")},
+		Txt:      []string{"version=1", "sig=old"},
+	}, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt := signTxt(key, zone, now)
+
+	// The entry assembled by the instancers
+	signed := Entry{
+		Name:   "node1",
+		Host:   "test.host.",
+		AddrV4: net.IPv4(127, 0, 0, 1),
+		AddrV6: net.ParseIP("::1"),
+		Port:   8080,
+		Txt:    parseTxt(txt),
+	}
+	if want, have := "1", signed.Txt["version"]; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	tamper := func(f func(entry *Entry)) Entry {
+		entry := signed
+		entry.Txt = map[string]string{}
+		for k, v := range signed.Txt {
+			entry.Txt[k] = v
+		}
+		f(&entry)
+		return entry
+	}
+	tests := []struct {
+		name  string
+		key   []byte
+		entry Entry
+		now   time.Time
+		want  error
+	}{
+		{"signed", key, signed, now, nil},
+		{"other key", []byte("other"), signed, now, errBadSignature},
+		{"stale", key, signed, now.Add(time.Hour), errStaleSignature},
+		{"unsigned", key, tamper(func(entry *Entry) { delete(entry.Txt, signatureKey) }), now, errUnsigned},
+		{"other port", key, tamper(func(entry *Entry) { entry.Port = 8081 }), now, errBadSignature},
+		{"other txt", key, tamper(func(entry *Entry) { entry.Txt["version"] = "2" }), now, errBadSignature},
+		{"spoofed address", key, tamper(func(entry *Entry) { entry.AddrV4 = net.IPv4(10, 0, 0, 1) }), now, errBadAddress},
+	}
+	for _, test := range tests {
+		if have := verifyEntry(test.key, "test.sign.mdns.kit", test.entry, test.now, time.Minute); test.want != have {
+			t.Errorf("%s: want: %v have: %v", test.name, test.want, have)
+		}
+	}
+
+	// The names unpacked by the instancers are escaped
+	zone, err = newZone(Service{
+		Service:  "test.sign.mdns.kit",
+		HostName: "test.host.",
+		Port:     8080,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, "web node (2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	escaped := Entry{
+		Name:   `web\ node\ \(2\)`,
+		Host:   "test.host.",
+		AddrV4: net.IPv4(127, 0, 0, 1),
+		Port:   8080,
+		Txt:    parseTxt(signTxt(key, zone, now)),
+	}
+	if have := verifyEntry(key, "test.sign.mdns.kit", escaped, now, time.Minute); have != nil {
+		t.Errorf("escaped name: want: <nil> have: %v", have)
+	}
+	escaped.Name = "web node (2)"
+	if have := verifyEntry(key, "test.sign.mdns.kit", escaped, now, time.Minute); have != nil {
+		t.Errorf("unescaped name: want: <nil> have: %v", have)
+	}
+}
@@ -0,0 +1,372 @@
+package mdns
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+// serviceTable assembles the entries of a service from the received resource records.
+// The names are compared case-insensitively, as per 16 in RFC 6762.
+// serviceTable is not goroutine-safe.
+type serviceTable struct {
+	serviceAddr string
+	ptrName     string                     // Name of the PTR records of the instances, the service or subtype address
+	instances   map[string]*instanceRecord // Keyed by the canonical instance address
+	hosts       map[string]*hostRecord     // Keyed by the canonical host name
+	received    metrics.Counter            // Complete entries new or changed by apply, may be nil
+
+	// snapshot tables hold the answers of unicast DNS, where zero TTL is legal and not a goodbye.
+	// They are not expired, but replaced by the next lookup.
+	snapshot bool
+}
+
+// instanceRecord holds the PTR, SRV and TXT records of an instance.
+// The records expire separately, the instance is removed when its PTR or SRV record expires.
+type instanceRecord struct {
+	name       string // Instance address, as received first
+	host       string
+	port       int
+	txt        []string
+	hasSRV     bool
+	ptrExpires time.Time // Zero if no PTR record is received
+	srvExpires time.Time
+	txtExpires time.Time
+}
+
+// hostRecord holds the A and AAAA records of a host.
+type hostRecord struct {
+	addrs []addrRecord
+}
+
+type addrRecord struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func newServiceTable(serviceAddr string) *serviceTable {
+	return newSubtypeTable(serviceAddr, serviceAddr)
+}
+
+// newSubtypeTable returns a table of the instances of the subtype, whose PTR records are named subtypeAddr.
+// The SRV and TXT records are applied only to the instances known from the PTR records.
+func newSubtypeTable(serviceAddr, subtypeAddr string) *serviceTable {
+	return &serviceTable{
+		serviceAddr: serviceAddr,
+		ptrName:     subtypeAddr,
+		instances:   map[string]*instanceRecord{},
+		hosts:       map[string]*hostRecord{},
+	}
+}
+
+// apply applies the records of the message to the table,
+// and reports whether the entries of the table has changed.
+// Records with zero TTL are goodbye records, as per 10.1 in RFC 6762, unless the table is a snapshot.
+func (t *serviceTable) apply(msg *dns.Msg, now time.Time) bool {
+	var before []*mdns.ServiceEntry
+	if t.received != nil {
+		before = t.serviceEntries()
+	}
+
+	records := make([]dns.RR, 0, len(msg.Answer)+len(msg.Extra))
+	records = append(records, msg.Answer...)
+	records = append(records, msg.Extra...)
+	// The PTR records first, so we know which instances are tracked
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Header().Rrtype == dns.TypePTR && records[j].Header().Rrtype != dns.TypePTR
+	})
+
+	changed := false
+	expires := func(rr dns.RR) time.Time {
+		return now.Add(time.Duration(rr.Header().Ttl) * time.Second)
+	}
+
+	// The instance records first, so we know which hosts are referenced
+	for _, rr := range records {
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if !equalNames(rr.Hdr.Name, t.ptrName) || !t.owns(rr.Ptr) {
+				continue
+			}
+			if t.goodbye(rr) {
+				changed = t.remove(rr.Ptr) || changed
+				continue
+			}
+			t.ensure(rr.Ptr).ptrExpires = expires(rr)
+
+		case *dns.SRV:
+			if !t.tracks(rr.Hdr.Name) {
+				continue
+			}
+			if t.goodbye(rr) {
+				changed = t.remove(rr.Hdr.Name) || changed
+				continue
+			}
+			record := t.ensure(rr.Hdr.Name)
+			if !record.hasSRV || !equalNames(record.host, rr.Target) || record.port != int(rr.Port) {
+				record.host, record.port, record.hasSRV = rr.Target, int(rr.Port), true
+				changed = true
+			}
+			record.srvExpires = expires(rr)
+
+		case *dns.TXT:
+			if !t.tracks(rr.Hdr.Name) {
+				continue
+			}
+			record, ok := t.instances[canonicalName(rr.Hdr.Name)]
+			if t.goodbye(rr) {
+				if ok && record.txt != nil {
+					record.txt = nil
+					changed = true
+				}
+				continue
+			}
+			if !ok {
+				record = t.ensure(rr.Hdr.Name)
+			}
+			if !reflect.DeepEqual(record.txt, rr.Txt) {
+				record.txt = rr.Txt
+				changed = true
+			}
+			record.txtExpires = expires(rr)
+		}
+	}
+
+	// Then the address records of the referenced hosts
+	for _, rr := range records {
+		var name string
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			name, ip = rr.Hdr.Name, rr.A
+		case *dns.AAAA:
+			name, ip = rr.Hdr.Name, rr.AAAA
+		default:
+			continue
+		}
+		if !t.referenced(name) {
+			continue
+		}
+
+		host, ok := t.hosts[canonicalName(name)]
+		if !ok {
+			host = &hostRecord{}
+			t.hosts[canonicalName(name)] = host
+		}
+		index := -1
+		for i, addr := range host.addrs {
+			if addr.ip.Equal(ip) {
+				index = i
+				break
+			}
+		}
+		if t.goodbye(rr) {
+			if index >= 0 {
+				host.addrs = append(host.addrs[:index], host.addrs[index+1:]...)
+				changed = true
+			}
+			continue
+		}
+		if index < 0 {
+			host.addrs = append(host.addrs, addrRecord{ip: ip})
+			index = len(host.addrs) - 1
+			changed = true
+		}
+		host.addrs[index].expires = expires(rr)
+	}
+
+	if t.received != nil {
+		addCounter(t.received, float64(countChanged(before, t.serviceEntries())))
+	}
+	return changed
+}
+
+// goodbye reports whether the record is a goodbye record.
+func (t *serviceTable) goodbye(rr dns.RR) bool {
+	return !t.snapshot && rr.Header().Ttl == 0
+}
+
+// matches reports whether any record of the message is applied to the table.
+func (t *serviceTable) matches(msg *dns.Msg) bool {
+	for _, records := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range records {
+			switch rr := rr.(type) {
+			case *dns.PTR:
+				if equalNames(rr.Hdr.Name, t.ptrName) && t.owns(rr.Ptr) {
+					return true
+				}
+			case *dns.SRV, *dns.TXT:
+				if t.tracks(rr.Header().Name) {
+					return true
+				}
+			case *dns.A, *dns.AAAA:
+				if t.referenced(rr.Header().Name) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// expire removes the instances and addresses whose records expired longer than the grace period,
+// and reports whether the entries of the table has changed.
+func (t *serviceTable) expire(now time.Time, grace time.Duration) bool {
+	if t.snapshot {
+		return false
+	}
+	deadline := now.Add(-grace)
+	changed := false
+	for name, record := range t.instances {
+		ptrExpired := !record.ptrExpires.IsZero() && record.ptrExpires.Before(deadline)
+		srvExpired := record.hasSRV && record.srvExpires.Before(deadline)
+		txtExpired := record.txt != nil && record.txtExpires.Before(deadline)
+		switch {
+		case ptrExpired || srvExpired:
+			changed = t.remove(name) || changed
+		case record.ptrExpires.IsZero() && !record.hasSRV && (record.txt == nil || txtExpired):
+			delete(t.instances, name) // nothing left of the instance
+		case txtExpired:
+			// the TXT record expires alone, the instance is kept without it
+			record.txt = nil
+			changed = changed || record.hasSRV
+		}
+	}
+	for _, host := range t.hosts {
+		addrs := host.addrs[:0]
+		for _, addr := range host.addrs {
+			if addr.expires.Before(deadline) {
+				changed = true
+			} else {
+				addrs = append(addrs, addr)
+			}
+		}
+		host.addrs = addrs
+	}
+	return changed
+}
+
+// incomplete returns the questions for the missing records of the instances.
+func (t *serviceTable) incomplete() []dns.Question {
+	var questions []dns.Question
+	for _, record := range t.instances {
+		if !record.hasSRV {
+			questions = append(questions, dns.Question{Name: record.name, Qtype: dns.TypeANY, Qclass: dns.ClassINET})
+		} else if host, ok := t.hosts[canonicalName(record.host)]; !ok || len(host.addrs) == 0 {
+			questions = append(questions,
+				dns.Question{Name: record.host, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				dns.Question{Name: record.host, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+		}
+	}
+	return questions
+}
+
+// serviceEntries returns the complete entries of the table, sorted by name.
+func (t *serviceTable) serviceEntries() []*mdns.ServiceEntry {
+	serviceEntries := make([]*mdns.ServiceEntry, 0, len(t.instances))
+	for _, record := range t.instances {
+		if !record.hasSRV {
+			continue
+		}
+		serviceEntry := &mdns.ServiceEntry{
+			Name:       record.name,
+			Host:       record.host,
+			Port:       record.port,
+			Info:       strings.Join(record.txt, "|"),
+			InfoFields: record.txt,
+		}
+		if host, ok := t.hosts[canonicalName(record.host)]; ok {
+			for _, addr := range host.addrs {
+				if addr.ip.To4() != nil {
+					if serviceEntry.AddrV4 == nil {
+						serviceEntry.AddrV4 = addr.ip
+					}
+				} else if serviceEntry.AddrV6 == nil {
+					serviceEntry.AddrV6 = addr.ip
+				}
+			}
+		}
+		if serviceEntry.AddrV4 == nil && serviceEntry.AddrV6 == nil {
+			continue // waiting for the address records
+		}
+		serviceEntries = append(serviceEntries, serviceEntry)
+	}
+	sort.Slice(serviceEntries, func(i, j int) bool {
+		return serviceEntries[i].Name < serviceEntries[j].Name
+	})
+	return serviceEntries
+}
+
+// countChanged returns the number of the entries which are new or changed since before.
+func countChanged(before, after []*mdns.ServiceEntry) int {
+	known := make(map[string]*mdns.ServiceEntry, len(before))
+	for _, serviceEntry := range before {
+		known[serviceEntry.Name] = serviceEntry
+	}
+	count := 0
+	for _, serviceEntry := range after {
+		if old, ok := known[serviceEntry.Name]; !ok || !reflect.DeepEqual(old, serviceEntry) {
+			count++
+		}
+	}
+	return count
+}
+
+// owns reports whether the instance address belongs to the service.
+func (t *serviceTable) owns(name string) bool {
+	return strings.HasSuffix(canonicalName(name), "."+canonicalName(t.serviceAddr))
+}
+
+// tracks reports whether the records of the instance are applied.
+// Only the instances known from the PTR records are tracked in the subtype tables,
+// the other instances of the service are not of the subtype.
+func (t *serviceTable) tracks(name string) bool {
+	if !t.owns(name) {
+		return false
+	}
+	if equalNames(t.ptrName, t.serviceAddr) {
+		return true
+	}
+	_, ok := t.instances[canonicalName(name)]
+	return ok
+}
+
+// referenced reports whether the host is referenced by any instance.
+func (t *serviceTable) referenced(host string) bool {
+	for _, record := range t.instances {
+		if record.hasSRV && equalNames(record.host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *serviceTable) ensure(name string) *instanceRecord {
+	key := canonicalName(name)
+	record, ok := t.instances[key]
+	if !ok {
+		record = &instanceRecord{name: name}
+		t.instances[key] = record
+	}
+	return record
+}
+
+// remove removes the instance, and the host records no longer referenced.
+func (t *serviceTable) remove(name string) bool {
+	key := canonicalName(name)
+	record, ok := t.instances[key]
+	if !ok {
+		return false
+	}
+	delete(t.instances, key)
+	if record.hasSRV && !t.referenced(record.host) {
+		delete(t.hosts, canonicalName(record.host))
+	}
+	return record.hasSRV
+}
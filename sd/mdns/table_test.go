@@ -0,0 +1,285 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+func newTestRecords(t *testing.T, instance, serviceName, hostName string, port int, ips []net.IP, txt []string) []dns.RR {
+	service, err := mdns.NewMDNSService(instance, serviceName, "", hostName, port, ips, txt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service.Records(dns.Question{Name: serviceName + ".local.", Qtype: dns.TypePTR})
+}
+
+func TestServiceTable(t *testing.T) {
+	table := newServiceTable("test.table.mdns.kit.local.")
+	now := time.Now()
+
+	// Records of another service are ignored
+	other := newTestRecords(t, "node0", "test.other.mdns.kit", "other.host.", 8080, []net.IP{net.IPv4(127, 0, 0, 2)}, nil)
+	if table.apply(&dns.Msg{Answer: other}, now) {
+		t.Error("want unchanged")
+	}
+
+	records := newTestRecords(t, "node1", "test.table.mdns.kit", "test.host.", 8080, []net.IP{net.IPv4(127, 0, 0, 1)}, []string{"zone=a"})
+	if !table.apply(&dns.Msg{Answer: records}, now) {
+		t.Error("want changed")
+	}
+	if table.apply(&dns.Msg{Answer: records}, now) {
+		t.Error("want unchanged")
+	}
+	serviceEntries := table.serviceEntries()
+	if want, have := 1, len(serviceEntries); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+	if want, have := "node1.test.table.mdns.kit.local.", serviceEntries[0].Name; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+	if want, have := "127.0.0.1", serviceEntries[0].AddrV4.String(); want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	// The instance is kept until the TTL and the grace period run out
+	ttl := time.Duration(records[0].Header().Ttl) * time.Second
+	if table.expire(now.Add(ttl), 0) {
+		t.Error("want unchanged")
+	}
+	if table.expire(now.Add(ttl+time.Second), time.Second*2) {
+		t.Error("want unchanged")
+	}
+	if !table.expire(now.Add(ttl+time.Second*3), time.Second*2) {
+		t.Error("want changed")
+	}
+	if want, have := 0, len(table.serviceEntries()); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+	if want, have := 0, len(table.hosts); want != have {
+		t.Fatalf("want %d hosts, have %d", want, have)
+	}
+}
+
+func TestServiceTableReceived(t *testing.T) {
+	table := newServiceTable("test.table.mdns.kit.local.")
+	received := generic.NewCounter("entries_received")
+	table.received = received
+	now := time.Now()
+
+	records := newTestRecords(t, "node1", "test.table.mdns.kit", "test.host.", 8080, []net.IP{net.IPv4(127, 0, 0, 1)}, []string{"zone=a"})
+	changed := newTestRecords(t, "node1", "test.table.mdns.kit", "test.host.", 8080, []net.IP{net.IPv4(127, 0, 0, 1)}, []string{"zone=b"})
+	other := newTestRecords(t, "node2", "test.table.mdns.kit", "other.host.", 8080, []net.IP{net.IPv4(127, 0, 0, 2)}, nil)
+	for _, test := range []struct {
+		records []dns.RR
+		want    float64
+	}{
+		{records[:1], 0}, // incomplete
+		{records, 1},
+		{records, 1}, // unchanged
+		{changed, 2},
+		{append(changed, other...), 3},
+	} {
+		table.apply(&dns.Msg{Answer: test.records}, now)
+		if have := received.Value(); test.want != have {
+			t.Errorf("want %f received, have %f", test.want, have)
+		}
+	}
+}
+
+func TestServiceTableCaseInsensitive(t *testing.T) {
+	table := newServiceTable("test.table.mdns.kit.local.")
+	now := time.Now()
+
+	// The responder answers in another case, as per 16 in RFC 6762
+	records := newTestRecords(t, "Node1", "TEST.table.mdns.kit", "Test.Host.", 8080, []net.IP{net.IPv4(127, 0, 0, 1)}, nil)
+	for _, rr := range records {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			ptr.Hdr.Name = "TEST.table.mdns.kit.LOCAL."
+		}
+	}
+	if !table.apply(&dns.Msg{Answer: records}, now) {
+		t.Error("want changed")
+	}
+	serviceEntries := table.serviceEntries()
+	if want, have := 1, len(serviceEntries); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+	if want, have := "Node1.TEST.table.mdns.kit.local.", serviceEntries[0].Name; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	// The records in yet another case are of the same instance
+	goodbye := newTestRecords(t, "NODE1", "test.table.mdns.kit", "test.host.", 8080, []net.IP{net.IPv4(127, 0, 0, 1)}, nil)
+	for _, rr := range goodbye {
+		rr.Header().Ttl = 0
+	}
+	if !table.apply(&dns.Msg{Answer: goodbye}, now) {
+		t.Error("want changed")
+	}
+	if want, have := 0, len(table.instances); want != have {
+		t.Fatalf("want %d instances, have %d", want, have)
+	}
+	if want, have := 0, len(table.hosts); want != have {
+		t.Fatalf("want %d hosts, have %d", want, have)
+	}
+}
+
+func TestServiceTableIncomplete(t *testing.T) {
+	table := newServiceTable("test.table.mdns.kit.local.")
+	records := newTestRecords(t, "node1", "test.table.mdns.kit", "test.host.", 8080, []net.IP{net.IPv4(127, 0, 0, 1)}, nil)
+
+	// The PTR record only
+	table.apply(&dns.Msg{Answer: records[:1]}, time.Now())
+	questions := table.incomplete()
+	if want, have := 1, len(questions); want != have {
+		t.Fatalf("want %d questions, have %d", want, have)
+	}
+	if want, have := "node1.test.table.mdns.kit.local.", questions[0].Name; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	// The SRV record without address
+	table.apply(&dns.Msg{Answer: records[1:2]}, time.Now())
+	questions = table.incomplete()
+	if want, have := 2, len(questions); want != have {
+		t.Fatalf("want %d questions, have %d", want, have)
+	}
+	if want, have := "test.host.", questions[0].Name; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+	if want, have := 0, len(table.serviceEntries()); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+
+	table.apply(&dns.Msg{Answer: records}, time.Now())
+	if want, have := 0, len(table.incomplete()); want != have {
+		t.Fatalf("want %d questions, have %d", want, have)
+	}
+	if want, have := 1, len(table.serviceEntries()); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+}
+
+func TestServiceTableMixedTTLs(t *testing.T) {
+	// setTTLs sets the TTLs as per 10 in RFC 6762, or short TXT TTL
+	setTTLs := func(records []dns.RR, txtTTL uint32) {
+		for _, rr := range records {
+			switch rr.(type) {
+			case *dns.PTR:
+				rr.Header().Ttl = 4500
+			case *dns.TXT:
+				rr.Header().Ttl = txtTTL
+			default:
+				rr.Header().Ttl = 120
+			}
+		}
+	}
+	now := time.Now()
+
+	// The instance expires with its SRV record, though the PTR and TXT records live longer
+	table := newServiceTable("test.table.mdns.kit.local.")
+	records := newTestRecords(t, "node1", "test.table.mdns.kit", "test.host.", 8080, []net.IP{net.IPv4(127, 0, 0, 1)}, []string{"zone=a"})
+	setTTLs(records, 4500)
+	table.apply(&dns.Msg{Answer: records}, now)
+	if table.expire(now.Add(time.Second*100), 0) {
+		t.Error("want unchanged")
+	}
+	if !table.expire(now.Add(time.Second*200), 0) {
+		t.Error("want changed")
+	}
+	if want, have := 0, len(table.instances); want != have {
+		t.Fatalf("want %d instances, have %d", want, have)
+	}
+
+	// The TXT record expires alone, the instance is kept without it
+	table = newServiceTable("test.table.mdns.kit.local.")
+	setTTLs(records, 10)
+	table.apply(&dns.Msg{Answer: records}, now)
+	if !table.expire(now.Add(time.Second*20), 0) {
+		t.Error("want changed")
+	}
+	serviceEntries := table.serviceEntries()
+	if want, have := 1, len(serviceEntries); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+	if want, have := 0, len(serviceEntries[0].InfoFields); want != have {
+		t.Errorf("want %d TXT strings, have %d", want, have)
+	}
+}
+
+func TestServiceTableGoodbye(t *testing.T) {
+	table := newServiceTable("test.table.mdns.kit.local.")
+	records := newTestRecords(t, "node1", "test.table.mdns.kit", "test.host.", 8080,
+		[]net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}, nil)
+	table.apply(&dns.Msg{Answer: records}, time.Now())
+
+	// One of the addresses says goodbye
+	var goodbye []dns.RR
+	for _, rr := range records {
+		if a, ok := rr.(*dns.A); ok && a.A.Equal(net.IPv4(127, 0, 0, 1)) {
+			a.Hdr.Ttl = 0
+			goodbye = append(goodbye, a)
+		}
+	}
+	if !table.apply(&dns.Msg{Answer: goodbye}, time.Now()) {
+		t.Error("want changed")
+	}
+	serviceEntries := table.serviceEntries()
+	if want, have := 1, len(serviceEntries); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+	if want, have := "127.0.0.2", serviceEntries[0].AddrV4.String(); want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+
+	// The instance says goodbye
+	for _, rr := range records {
+		rr.Header().Ttl = 0
+	}
+	if !table.apply(&dns.Msg{Answer: records[:1]}, time.Now()) {
+		t.Error("want changed")
+	}
+	if want, have := 0, len(table.serviceEntries()); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+}
+
+func TestServiceTableSubtype(t *testing.T) {
+	serviceName := "test.table.mdns.kit"
+	table := newSubtypeTable(serviceName+".local.", "_primary._sub."+serviceName+".local.")
+	now := time.Now()
+
+	newZoneRecords := func(instance string, subtypes []string) []dns.RR {
+		zone, err := newZone(Service{
+			Service:  serviceName,
+			HostName: instance + ".host.",
+			Port:     8080,
+			Ips:      []net.IP{net.IPv4(127, 0, 0, 1)},
+			Subtypes: subtypes,
+		}, instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records(zone)
+	}
+
+	// The instances not of the subtype are ignored
+	if table.apply(&dns.Msg{Answer: newZoneRecords("node1", []string{"_canary"})}, now) {
+		t.Error("want unchanged")
+	}
+	if !table.apply(&dns.Msg{Answer: newZoneRecords("node2", []string{"_canary", "_primary"})}, now) {
+		t.Error("want changed")
+	}
+	serviceEntries := table.serviceEntries()
+	if want, have := 1, len(serviceEntries); want != have {
+		t.Fatalf("want %d entries, have %d", want, have)
+	}
+	if want, have := "node2.test.table.mdns.kit.local.", serviceEntries[0].Name; want != have {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
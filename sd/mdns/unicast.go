@@ -0,0 +1,122 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UnicastMode decides when the services are looked up over unicast DNS-SD.
+type UnicastMode int
+
+const (
+	// UnicastFallback looks up over unicast DNS-SD when multicast finds no instances.
+	UnicastFallback UnicastMode = iota
+	// UnicastOnly looks up over unicast DNS-SD only, multicast is not used at all.
+	UnicastOnly
+)
+
+// unicastResolver resolves the instances of a service over unicast DNS-SD, as per RFC 6763.
+// It follows the PTR records to the SRV and TXT records, and the SRV records to the A and AAAA records.
+type unicastResolver struct {
+	server  string
+	timeout time.Duration
+}
+
+// lookup returns the records of the instances, whose PTR records are named ptrName.
+func (r *unicastResolver) lookup(ctx context.Context, ptrName string) ([]dns.RR, error) {
+	records, err := r.exchange(ctx, ptrName, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []string
+	for _, rr := range records {
+		if ptr, ok := rr.(*dns.PTR); ok && equalNames(ptr.Hdr.Name, ptrName) {
+			instances = append(instances, ptr.Ptr)
+		}
+	}
+	for _, instance := range instances {
+		for _, qtype := range []uint16{dns.TypeSRV, dns.TypeTXT} {
+			if hasRecord(records, instance, qtype) {
+				continue // in the additional section already
+			}
+			answer, err := r.exchange(ctx, instance, qtype)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, answer...)
+		}
+	}
+
+	var hosts []string
+	for _, rr := range records {
+		if srv, ok := rr.(*dns.SRV); ok {
+			hosts = append(hosts, srv.Target)
+		}
+	}
+	for _, host := range hosts {
+		if hasRecord(records, host, dns.TypeA) || hasRecord(records, host, dns.TypeAAAA) {
+			continue
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			answer, err := r.exchange(ctx, host, qtype)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, answer...)
+		}
+	}
+	return records, nil
+}
+
+// exchange queries the server for the records of the name and type,
+// the records of the answer and additional sections are returned.
+// The truncated responses are retried over TCP.
+func (r *unicastResolver) exchange(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+
+	var resp *dns.Msg
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network, Timeout: r.timeout}
+		var err error
+		resp, _, err = client.ExchangeContext(ctx, query, r.server)
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Truncated {
+			break
+		}
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, nil // no such name
+	default:
+		return nil, fmt.Errorf("dns query %s %s failed: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+
+	records := make([]dns.RR, 0, len(resp.Answer)+len(resp.Extra))
+	records = append(records, resp.Answer...)
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			records = append(records, rr)
+		}
+	}
+	return records, nil
+}
+
+// hasRecord reports whether the records contains any record of the name and type.
+// The names are compared case-insensitively.
+func hasRecord(records []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range records {
+		if rr.Header().Rrtype == qtype && equalNames(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
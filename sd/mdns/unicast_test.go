@@ -0,0 +1,127 @@
+package mdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+// newTestDNSServer starts a unicast DNS server answering for the zone.
+// Only the records of the question type are answered, so the resolver follows the records.
+func newTestDNSServer(t *testing.T, zone mdns.Zone) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			for _, rr := range zone.Records(query.Question[0]) {
+				if rr.Header().Rrtype == query.Question[0].Qtype {
+					resp.Answer = append(resp.Answer, rr)
+				}
+			}
+			if len(resp.Answer) == 0 {
+				resp.Rcode = dns.RcodeNameError
+			}
+			w.WriteMsg(resp)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestMDNSInstancerUnicast(t *testing.T) {
+	serviceName := "_test-unicast._tcp"
+	zone, err := newZone(Service{
+		Service:  serviceName,
+		Domain:   "example.com.",
+		HostName: "node1.example.com.",
+		Port:     8081,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)}, // Just for test
+		Txt:      []string{"version=1"},
+	}, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, shutdown := newTestDNSServer(t, zone)
+	defer shutdown()
+
+	for _, mode := range []UnicastMode{UnicastOnly, UnicastFallback} {
+		instancer, err := NewInstancer(serviceName, InstancerOptions{
+			UnicastServer: server,
+			UnicastDomain: "example.com",
+			UnicastMode:   mode,
+		}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := []string{"127.0.0.1:8081"}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+			t.Errorf("mode %d: want: %s have: %s", mode, want, have)
+		}
+		entries := instancer.EntryState().Entries
+		if len(entries) != 1 || entries[0].Name != "node1" || entries[0].Txt["version"] != "1" {
+			t.Errorf("mode %d: unexpected entries %+v", mode, entries)
+		}
+		instancer.Stop()
+	}
+}
+
+// zeroTTLZone answers the records of the zone with zero TTL, which is legal in unicast DNS.
+type zeroTTLZone struct {
+	mdns.Zone
+}
+
+func (z zeroTTLZone) Records(q dns.Question) []dns.RR {
+	records := z.Zone.Records(q)
+	for _, rr := range records {
+		rr.Header().Ttl = 0
+	}
+	return records
+}
+
+func TestMDNSInstancerUnicastZeroTTL(t *testing.T) {
+	serviceName := "_test-unicast-ttl._tcp"
+	zone, err := newZone(Service{
+		Service:  serviceName,
+		Domain:   "example.com.",
+		HostName: "node1.example.com.",
+		Port:     8081,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)}, // Just for test
+	}, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, shutdown := newTestDNSServer(t, zeroTTLZone{zone})
+	defer shutdown()
+
+	instancer, err := NewInstancer(serviceName, InstancerOptions{
+		UnicastServer: server,
+		UnicastDomain: "example.com",
+		UnicastMode:   UnicastOnly,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	// The records are neither goodbyes, nor expired before the next lookup
+	if want, have := []string{"127.0.0.1:8081"}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+	time.Sleep(expiryCheckInterval * 2)
+	if want, have := []string{"127.0.0.1:8081"}, instancer.State().Instances; !reflect.DeepEqual(want, have) {
+		t.Errorf("want: %s have: %s", want, have)
+	}
+}
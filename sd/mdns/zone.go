@@ -0,0 +1,162 @@
+package mdns
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+// defaultTTL is the TTL of the records, the same as the records of hashicorp/mdns.
+const defaultTTL = 120
+
+// serviceZone answers for the records of an instance,
+// and the PTR records of its subtypes, as per 7.1 in RFC 6763.
+type serviceZone struct {
+	*mdns.MDNSService
+	subtypes []string          // Fully qualified subtype addresses
+	names    map[string]string // Names of the records built by hashicorp/mdns, keyed by the canonical names
+}
+
+func newZone(service Service, instance string) (*serviceZone, error) {
+	zone, err := mdns.NewMDNSService(instance, service.Service,
+		service.Domain, service.HostName, service.Port, service.Ips, service.Txt)
+	if err != nil {
+		return nil, err
+	}
+
+	subtypes := make([]string, 0, len(service.Subtypes))
+	for _, subtype := range service.Subtypes {
+		subtypes = append(subtypes, subtypeAddress(subtype, zone.Service, zone.Domain))
+	}
+	z := &serviceZone{MDNSService: zone, subtypes: subtypes, names: map[string]string{}}
+	for _, name := range append([]string{
+		z.instanceAddr(),
+		z.serviceAddr(),
+		serviceAddress(servicesEnumeration, z.Domain),
+		z.HostName,
+	}, subtypes...) {
+		z.names[canonicalName(name)] = name
+	}
+	return z, nil
+}
+
+// canonicalName returns the name in the escaped presentation form of miekg/dns, in lower case.
+// hashicorp/mdns builds the names unescaped, such as "node1 (2)._http._tcp.local.",
+// while the names unpacked from the messages are escaped, such as "node1\ \(2\)._http._tcp.local.".
+func canonicalName(name string) string {
+	buf := make([]byte, 256)
+	off, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	canonical, _, err := dns.UnpackDomainName(buf[:off], 0)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(canonical)
+}
+
+// unescapeName returns the labels of the name unescaped, joined by dots,
+// such as "node1 (2)" for "node1\ \(2\)".
+func unescapeName(name string) string {
+	buf := make([]byte, 256)
+	off, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return name
+	}
+	var labels []string
+	for i := 0; i < off && buf[i] != 0; i += int(buf[i]) + 1 {
+		labels = append(labels, string(buf[i+1:i+1+int(buf[i])]))
+	}
+	return strings.Join(labels, ".")
+}
+
+// equalNames reports whether the names are the same domain name, ignoring the escaping and the case.
+func equalNames(a, b string) bool {
+	return a == b || canonicalName(a) == canonicalName(b)
+}
+
+// subtypeAddress returns the fully qualified subtype address, such as "_primary._sub._http._tcp.local.".
+func subtypeAddress(subtype, service, domain string) string {
+	return fmt.Sprintf("%s._sub.%s", strings.Trim(subtype, "."), serviceAddress(service, domain))
+}
+
+func (z *serviceZone) serviceAddr() string {
+	return serviceAddress(z.Service, z.Domain)
+}
+
+func (z *serviceZone) instanceAddr() string {
+	return fmt.Sprintf("%s.%s", z.Instance, z.serviceAddr())
+}
+
+// Records implements mdns.Zone.
+// The names of the questions are matched in the canonical form, see canonicalName.
+func (z *serviceZone) Records(q dns.Question) []dns.RR {
+	if name, ok := z.names[canonicalName(q.Name)]; ok {
+		q.Name = name
+	}
+	for _, subtype := range z.subtypes {
+		if q.Name != subtype {
+			continue
+		}
+		if q.Qtype != dns.TypePTR && q.Qtype != dns.TypeANY {
+			return nil
+		}
+		ptr := &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   subtype,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    defaultTTL,
+			},
+			Ptr: z.instanceAddr(),
+		}
+		return append([]dns.RR{ptr}, z.MDNSService.Records(dns.Question{
+			Name:   z.instanceAddr(),
+			Qtype:  dns.TypeANY,
+			Qclass: dns.ClassINET,
+		})...)
+	}
+	return z.MDNSService.Records(q)
+}
+
+// addressRecords returns the A and AAAA records of the instance.
+func addressRecords(zone *serviceZone) []dns.RR {
+	var records []dns.RR
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		records = append(records, zone.Records(dns.Question{
+			Name:   zone.HostName,
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		})...)
+	}
+	return records
+}
+
+// txtRecords returns the TXT records of the instance.
+func txtRecords(zone *serviceZone) []dns.RR {
+	return zone.Records(dns.Question{
+		Name:   zone.instanceAddr(),
+		Qtype:  dns.TypeTXT,
+		Qclass: dns.ClassINET,
+	})
+}
+
+// records returns all the records of the instance, with the PTR records of the subtypes.
+func records(zone *serviceZone) []dns.RR {
+	records := zone.Records(dns.Question{
+		Name:   zone.serviceAddr(),
+		Qtype:  dns.TypePTR,
+		Qclass: dns.ClassINET,
+	})
+	for _, subtype := range zone.subtypes {
+		records = append(records, zone.Records(dns.Question{
+			Name:   subtype,
+			Qtype:  dns.TypePTR,
+			Qclass: dns.ClassINET,
+		})[0])
+	}
+	return records
+}
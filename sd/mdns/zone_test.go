@@ -0,0 +1,55 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneEscapedNames(t *testing.T) {
+	zone, err := newZone(Service{
+		Service:  "test.zone.mdns.kit",
+		HostName: "host1.",
+		Port:     8080,
+		Ips:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		Subtypes: []string{"primary"},
+	}, "node1 (2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The names unpacked from the queries are escaped
+	escaped := `node1\ \(2\).test.zone.mdns.kit.local.`
+	if !equalNames(escaped, zone.instanceAddr()) {
+		t.Fatalf("want %s equal to %s", escaped, zone.instanceAddr())
+	}
+	if !equalNames("NODE1 (2).TEST.zone.mdns.kit.local.", zone.instanceAddr()) {
+		t.Fatal("want the names equal ignoring the case")
+	}
+
+	for _, qtype := range []uint16{dns.TypeSRV, dns.TypeTXT, dns.TypeANY} {
+		answer := zone.Records(dns.Question{Name: escaped, Qtype: qtype, Qclass: dns.ClassINET})
+		if len(answer) == 0 {
+			t.Errorf("want answers of %s %s", escaped, dns.TypeToString[qtype])
+		}
+	}
+	answer := zone.Records(dns.Question{Name: "PRIMARY._sub.test.zone.mdns.kit.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+	if len(answer) == 0 {
+		t.Error("want answers of the subtype")
+	}
+
+	// The records of the message match the name
+	msg := &dns.Msg{MsgHdr: dns.MsgHdr{Response: true}, Answer: records(zone)}
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unpacked dns.Msg
+	if err := unpacked.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if have := recordsOf(zone.instanceAddr(), unpacked.Answer); len(have) == 0 {
+		t.Errorf("want the records of %s in the unpacked message", zone.instanceAddr())
+	}
+}